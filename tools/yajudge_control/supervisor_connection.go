@@ -2,10 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -28,10 +37,38 @@ func NewSupervisorConnection(socketFileName string) (*SupervisorConnection, erro
 	return result, nil
 }
 
+// NewRemoteSupervisorConnection connects to supervisor remote API with mutual TLS
+func NewRemoteSupervisorConnection(address, certFile, keyFile, caFile string) (*SupervisorConnection, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cant load client certificate: %v", err)
+	}
+	caData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cant read CA file: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      rootCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+	result := &SupervisorConnection{
+		Connection: conn,
+		Client:     NewSupervisorClient(conn),
+	}
+	return result, nil
+}
+
 func makeContext() context.Context {
-	return context.Background() // TODO remove this line while debugged
-	ctx, _ := context.WithTimeout(context.Background(), 1*time.Second)
-	return ctx
+	return context.Background()
 }
 
 func (conn *SupervisorConnection) ShowInstancesList() {
@@ -52,28 +89,130 @@ func (conn *SupervisorConnection) ShowStatus(instance string) {
 		log.Fatal(err)
 	}
 	conn.PrintStatuses(response)
+	conn.PrintSchedule(response)
+	conn.PrintResourceUsage(response)
+}
+
+// PrintSchedule shows current maintenance and upcoming scheduled actions of instance
+func (conn *SupervisorConnection) PrintSchedule(response *StatusResponse) {
+	const timeFormat = "2006-01-02 15:04"
+	if response.MaintenanceUntil != 0 {
+		fmt.Printf("\nUnder maintenance until %s\n", time.Unix(response.MaintenanceUntil, 0).Format(timeFormat))
+	}
+	if len(response.ScheduledActions) == 0 {
+		return
+	}
+	fmt.Println("\nScheduled:")
+	for _, action := range response.ScheduledActions {
+		description := action.Action
+		if action.Until != 0 {
+			description += " until " + time.Unix(action.Until, 0).Format(timeFormat)
+		}
+		if len(action.ServiceNames) > 0 {
+			description += " of " + strings.Join(action.ServiceNames, ", ")
+		}
+		fmt.Printf(" * %s %s\n", time.Unix(action.Time, 0).Format(timeFormat), description)
+	}
 }
 
 func (conn *SupervisorConnection) PrintStatuses(response *StatusResponse) {
 	for _, serviceStatus := range response.ServiceStatuses {
-		if serviceStatus.Status == ServiceStatus_RUNNING {
-			fmt.Printf(" * %s [RUNNING][pid=%v, uptime %v seconds, crashed %v times]\n",
-				serviceStatus.ServiceName, serviceStatus.Pid, serviceStatus.Uptime, serviceStatus.CrashesSinceStart,
-			)
-		} else if serviceStatus.Status == ServiceStatus_DISABLED {
-			fmt.Printf(" * %s [DISABLED]\n", serviceStatus.ServiceName)
-		} else if serviceStatus.Status == ServiceStatus_STOPPED {
-			fmt.Printf(" * %s [STOPPED]\n", serviceStatus.ServiceName)
-		} else if serviceStatus.Status == ServiceStatus_FAILED {
-			fmt.Printf(" * %s [FAILED]: %s\n", serviceStatus.ServiceName, serviceStatus.FailReason)
-		} else if serviceStatus.Status == ServiceStatus_DEAD {
-			fmt.Printf(" * %s [DEAD][crashed %v times]\n",
-				serviceStatus.ServiceName, serviceStatus.CrashesSinceStart,
-			)
+		if line := formatStatus(serviceStatus); line != "" {
+			fmt.Println(line)
 		}
 	}
 }
 
+func formatStatus(serviceStatus *ServiceStatusResponse) string {
+	switch serviceStatus.Status {
+	case ServiceStatus_RUNNING:
+		return fmt.Sprintf(" * %s [RUNNING][pid=%v, uptime %v seconds, crashed %v times%s]%s",
+			serviceStatus.ServiceName, serviceStatus.Pid, serviceStatus.Uptime, serviceStatus.CrashesSinceStart,
+			formatHealth(serviceStatus), formatStatusText(serviceStatus),
+		)
+	case ServiceStatus_UNHEALTHY:
+		return fmt.Sprintf(" * %s [UNHEALTHY][pid=%v]: %s",
+			serviceStatus.ServiceName, serviceStatus.Pid, serviceStatus.FailReason,
+		)
+	case ServiceStatus_DISABLED:
+		return fmt.Sprintf(" * %s [DISABLED]", serviceStatus.ServiceName)
+	case ServiceStatus_STOPPED:
+		return fmt.Sprintf(" * %s [STOPPED]", serviceStatus.ServiceName)
+	case ServiceStatus_FAILED:
+		return fmt.Sprintf(" * %s [FAILED]: %s", serviceStatus.ServiceName, serviceStatus.FailReason)
+	case ServiceStatus_RESPAWNING:
+		return fmt.Sprintf(" * %s [RESPAWNING][crashed %v times]",
+			serviceStatus.ServiceName, serviceStatus.CrashesSinceStart,
+		)
+	case ServiceStatus_DRAINING:
+		return fmt.Sprintf(" * %s [DRAINING][pid=%v]%s",
+			serviceStatus.ServiceName, serviceStatus.Pid, formatStatusText(serviceStatus),
+		)
+	case ServiceStatus_DEAD:
+		return fmt.Sprintf(" * %s [DEAD][crashed %v times]",
+			serviceStatus.ServiceName, serviceStatus.CrashesSinceStart,
+		)
+	}
+	return ""
+}
+
+func formatHealth(serviceStatus *ServiceStatusResponse) string {
+	switch serviceStatus.Health {
+	case HealthState_HEALTH_SERVING:
+		return fmt.Sprintf(", healthy, probe %v us", serviceStatus.ProbeLatencyUs)
+	case HealthState_HEALTH_NOT_SERVING:
+		return ", not healthy"
+	default:
+		return ""
+	}
+}
+
+// formatStatusText returns status reported by service itself
+func formatStatusText(serviceStatus *ServiceStatusResponse) string {
+	if serviceStatus.StatusText == "" {
+		return ""
+	}
+	return ": " + serviceStatus.StatusText
+}
+
+// PrintResourceUsage renders table of running services resource usage
+func (conn *SupervisorConnection) PrintResourceUsage(response *StatusResponse) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	hasRows := false
+	for _, serviceStatus := range response.ServiceStatuses {
+		usage := serviceStatus.Usage
+		if usage == nil {
+			continue
+		}
+		if !hasRows {
+			fmt.Println()
+			fmt.Fprintf(table, "SERVICE\tPID\tCPU%%\tCPU TIME\tRSS\tFDS\tTHREADS\tIO READ\tIO WRITE\t\n")
+			hasRows = true
+		}
+		fmt.Fprintf(table, "%s\t%d\t%.1f\t%.1fs\t%s\t%d\t%d\t%s\t%s\t\n",
+			serviceStatus.ServiceName, serviceStatus.Pid, usage.CpuPercent, usage.CpuTimeSec,
+			formatBytes(usage.MemoryRssBytes), usage.OpenFds, usage.Threads,
+			formatBytes(usage.IoReadBytes), formatBytes(usage.IoWriteBytes),
+		)
+	}
+	table.Flush()
+}
+
+func formatBytes(value int64) string {
+	const unit = 1024
+	if value < unit {
+		return fmt.Sprintf("%dB", value)
+	}
+	suffixes := "KMGTP"
+	divisor := int64(unit)
+	index := 0
+	for value/divisor >= unit && index < len(suffixes)-1 {
+		divisor *= unit
+		index++
+	}
+	return fmt.Sprintf("%.1f%c", float64(value)/float64(divisor), suffixes[index])
+}
+
 func (conn *SupervisorConnection) DoStart(instance string, services []string) {
 	response, err := conn.Client.Start(context.Background(), &StartRequest{
 		InstanceName: instance,
@@ -96,7 +235,234 @@ func (conn *SupervisorConnection) DoStop(instance string, services []string) {
 	conn.PrintStatuses(response)
 }
 
+func (conn *SupervisorConnection) DoReset(instance string, services []string) {
+	response, err := conn.Client.Reset(context.Background(), &ResetRequest{
+		InstanceName: instance,
+		ServiceNames: services,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn.PrintStatuses(response)
+}
+
+func (conn *SupervisorConnection) DoDrain(instance string, services []string) {
+	response, err := conn.Client.Drain(context.Background(), &DrainRequest{
+		InstanceName: instance,
+		ServiceNames: services,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn.PrintStatuses(response)
+}
+
+func (conn *SupervisorConnection) DoScale(instance string, service string, replicas int) {
+	response, err := conn.Client.Scale(context.Background(), &ScaleRequest{
+		InstanceName: instance,
+		ServiceName:  service,
+		Replicas:     int32(replicas),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn.PrintStatuses(response)
+}
+
+func (conn *SupervisorConnection) DoLogs(instance string, services []string, backlog int, level string, follow bool) {
+	stream, err := conn.Client.StreamLogs(context.Background(), &LogsRequest{
+		InstanceName: instance,
+		ServiceNames: services,
+		Backlog:      int32(backlog),
+		Level:        level,
+		Follow:       follow,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	prefixWidth := 0
+	for _, serviceName := range services {
+		if len(serviceName) > prefixWidth {
+			prefixWidth = len(serviceName)
+		}
+	}
+	for {
+		logLine, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(logLine.ServiceName) > prefixWidth {
+			prefixWidth = len(logLine.ServiceName)
+		}
+		fmt.Printf("%-*s | %s\n", prefixWidth, logLine.ServiceName, logLine.Line)
+	}
+}
+
+// DoWatch prints services status changes until interrupted
+func (conn *SupervisorConnection) DoWatch(instance string) {
+	stream, err := conn.Client.WatchStatus(context.Background(), &WatchStatusRequest{
+		InstanceName: instance,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if status.Code(err) == codes.ResourceExhausted {
+			// supervisor dropped slow subscription, current statuses are sent again
+			fmt.Fprintf(os.Stderr, "some changes are lost, resubscribing\n")
+			stream, err = conn.Client.WatchStatus(context.Background(), &WatchStatusRequest{
+				InstanceName: instance,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		line := formatStatus(event.Status)
+		if line == "" {
+			line = fmt.Sprintf(" * %s [%v]", event.Status.ServiceName, event.Status.Status)
+		}
+		eventTime := time.Unix(event.Time, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%s %s%s\n", eventTime, event.InstanceName, line)
+	}
+}
+
+func (conn *SupervisorConnection) DoReload() {
+	response, err := conn.Client.Reload(context.Background(), &Empty{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, instanceName := range response.AddedInstances {
+		fmt.Printf(" + %s\n", instanceName)
+	}
+	for _, instanceName := range response.RemovedInstances {
+		fmt.Printf(" - %s\n", instanceName)
+	}
+	for _, change := range response.Changes {
+		fmt.Printf(" * %s\n", change)
+	}
+	if len(response.AddedInstances)+len(response.RemovedInstances)+len(response.Changes) == 0 {
+		fmt.Printf("no changes\n")
+	}
+}
+
 func (conn *SupervisorConnection) DoRestart(instance string, services []string) {
 	conn.DoStop(instance, services)
 	conn.DoStart(instance, services)
 }
+
+func (conn *SupervisorConnection) DoRollingRestart(instance string, services []string) {
+	stream, err := conn.Client.RollingRestart(context.Background(), &RollingRestartRequest{
+		InstanceName: instance,
+		ServiceNames: services,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %s\n", progress.ServiceName, progress.Message)
+	}
+	conn.ShowStatus(instance)
+}
+
+func (conn *SupervisorConnection) ShowEvents(instance, service string, limit int) {
+	response, err := conn.Client.GetServiceEvents(context.Background(), &EventsRequest{
+		InstanceName: instance,
+		ServiceName:  service,
+		Limit:        int32(limit),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(response.Events) == 0 {
+		fmt.Println("no events")
+	}
+	for _, event := range response.Events {
+		eventTime := time.Unix(event.Timestamp, 0).Format("2006-01-02 15:04:05")
+		eventName := strings.TrimPrefix(event.Type.String(), "EVENT_")
+		fmt.Printf("%s %-17s %s\n", eventTime, eventName, formatEventDetails(event))
+		for _, line := range event.StderrTail {
+			fmt.Printf("    | %s\n", line)
+		}
+	}
+}
+
+func formatEventDetails(event *ServiceEvent) string {
+	details := make([]string, 0, 5)
+	if event.Pid != 0 {
+		details = append(details, fmt.Sprintf("pid=%d", event.Pid))
+	}
+	if event.Type == ServiceEventType_EVENT_EXITED || event.Type == ServiceEventType_EVENT_STOPPED {
+		if event.Signal != "" {
+			details = append(details, "killed by "+event.Signal)
+		} else if event.ExitCode < 0 {
+			details = append(details, "exit code unknown")
+		} else {
+			details = append(details, fmt.Sprintf("exit code %d", event.ExitCode))
+		}
+		if event.CoreDumped {
+			details = append(details, "core dumped")
+		}
+		details = append(details, fmt.Sprintf("uptime %v seconds", event.Uptime))
+	}
+	if event.Message != "" {
+		details = append(details, event.Message)
+	}
+	return strings.Join(details, ", ")
+}
+
+func (conn *SupervisorConnection) ShowAudit(instance string, since time.Time, limit int) {
+	request := &AuditRequest{InstanceName: instance, Limit: int32(limit)}
+	if !since.IsZero() {
+		request.Since = since.Unix()
+	}
+	response, err := conn.Client.GetAuditLog(context.Background(), request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(response.Records) == 0 {
+		fmt.Println("no records")
+	}
+	if response.Truncated {
+		fmt.Printf("older records omitted, use --since or -n to select them\n")
+	}
+	for _, record := range response.Records {
+		recordTime := time.Unix(record.Time, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%s %-14s %s\n", recordTime, record.Method, formatAuditDetails(record))
+	}
+}
+
+func formatAuditDetails(record *AuditRecord) string {
+	details := make([]string, 0, 5)
+	if record.Certificate != "" || record.RemoteAddr != "" {
+		details = append(details, fmt.Sprintf("certificate '%s' from %s", record.Certificate, record.RemoteAddr))
+	} else {
+		details = append(details, fmt.Sprintf("uid=%d pid=%d", record.Uid, record.Pid))
+	}
+	if record.InstanceName != "" {
+		target := "instance " + record.InstanceName
+		if len(record.ServiceNames) > 0 {
+			target += " [" + strings.Join(record.ServiceNames, ", ") + "]"
+		}
+		details = append(details, target)
+	}
+	details = append(details, record.Result)
+	return strings.Join(details, ", ")
+}
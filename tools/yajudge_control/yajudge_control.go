@@ -7,7 +7,9 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ServerConfig struct {
@@ -16,15 +18,43 @@ type ServerConfig struct {
 
 func main() {
 	configFileName := flag.String("C", "", "config file name")
+	remoteAddress := flag.String("remote", "", "remote supervisor host:port instead of local socket")
+	certFile := flag.String("cert", "", "client certificate file for remote supervisor")
+	keyFile := flag.String("key", "", "client private key file for remote supervisor")
+	caFile := flag.String("ca", "", "CA certificate file to verify remote supervisor")
 	flag.Parse()
-	if *configFileName == "" {
+	cmdLineArgs := flag.Args()
+	if len(cmdLineArgs) < 1 {
+		showHelpAndExit()
+	}
+	var connection *SupervisorConnection
+	var err error
+	if *remoteAddress != "" {
+		if *certFile == "" || *keyFile == "" || *caFile == "" {
+			log.Fatalf("remote connection requires --cert, --key and --ca options")
+		}
+		connection, err = NewRemoteSupervisorConnection(*remoteAddress, *certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalf("cant connect to remote supervisor %s: %v", *remoteAddress, err)
+		}
+	} else {
+		connection = newLocalConnection(*configFileName)
+	}
+	command := strings.ToLower(cmdLineArgs[0])
+	commandArguments := cmdLineArgs[1:]
+	processCommand(connection, command, commandArguments)
+	connection.Connection.Close()
+}
+
+func newLocalConnection(configFileName string) *SupervisorConnection {
+	if configFileName == "" {
 		configDir, err := resolveDefaultConfDir()
 		if err != nil {
 			log.Fatal(err)
 		}
-		*configFileName = path.Join(configDir, "server.yaml")
+		configFileName = path.Join(configDir, "server.yaml")
 	}
-	serverConfig, err := loadServerConfig(*configFileName)
+	serverConfig, err := loadServerConfig(configFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -40,25 +70,45 @@ func main() {
 	if err != nil {
 		log.Fatalf("cant connect to supervisor service. Ensure supervisor is running. Error: %v", err)
 	}
-	cmdLineArgs := flag.Args()
-	if len(cmdLineArgs) < 1 {
-		showHelpAndExit()
-	}
-	command := strings.ToLower(cmdLineArgs[0])
-	commandArguments := cmdLineArgs[1:]
-	processCommand(connection, command, commandArguments)
-	connection.Connection.Close()
+	return connection
 }
 
 func showHelpAndExit() {
 	message := `
-Usage: yajudge-control COMMAND [INSTANCE] [SERVICES]
+Usage: yajudge-control [OPTIONS] COMMAND [INSTANCE] [SERVICES]
+  OPTIONS are:
+    -C FILE                         - server.yaml of local supervisor
+    --remote HOST:PORT --cert FILE --key FILE --ca FILE
+                                    - manage remote supervisor using client
+                                      certificate and key, server certificate
+                                      is verified by CA certificate
   COMMAND is one of:
     * list                          - show list of available instances
+    * reload                        - reread configuration and show changes
     * status  INSTANCE              - show status on instance
+    * watch   [INSTANCE]            - show services status changes as they
+                                      happen, of all instances if not specified
     * start   INSTANCE [SERVICES]   - start instance services
     * stop    INSTANCE [SERVICES]   - stop instance services
     * restart INSTANCE [SERVICES]   - restart instance services
+    * rolling-restart INSTANCE [SERVICES]
+                                    - restart running services one by one
+                                      without downtime
+    * logs    INSTANCE [SERVICES] [-f] [-n LINES] [-l LEVEL]
+                                    - show instance services logs,
+                                      follow new lines if -f specified
+    * reset   INSTANCE SERVICES     - clear DEAD or FAILED state of services
+                                      to allow them to be started again
+    * scale   INSTANCE grader COUNT - start or stop grader replicas
+    * drain   INSTANCE [SERVICES]   - stop graders (all replicas by default)
+                                      after in-flight submissions are finished
+    * events  INSTANCE SERVICE [-n COUNT]
+                                    - show service starts, exits and restarts
+    * audit   [INSTANCE] [--since TIME] [-n COUNT]
+                                    - show who started, stopped or otherwise
+                                      changed services, TIME is duration ago
+                                      like 2h or local 'YYYY-MM-DD [HH:MM]',
+                                      last 1000 records at most are shown
   INSTANCE might be yajudge service instance of 'webserver'
   If SERVICES specified then start, stop or restart will affect only 
   specified services.
@@ -76,6 +126,23 @@ func processCommand(connection *SupervisorConnection, command string, arguments
 		connection.ShowInstancesList()
 		return
 	}
+	if command == "reload" {
+		connection.DoReload()
+		return
+	}
+	if command == "watch" {
+		instanceName := ""
+		if len(arguments) > 0 {
+			instanceName = arguments[0]
+		}
+		connection.DoWatch(instanceName)
+		return
+	}
+	if command == "audit" {
+		instanceName, since, limit := parseAuditArguments(arguments)
+		connection.ShowAudit(instanceName, since, limit)
+		return
+	}
 	if len(arguments) == 0 {
 		log.Fatalf("requires instance name for this operation")
 	}
@@ -97,6 +164,133 @@ func processCommand(connection *SupervisorConnection, command string, arguments
 		connection.DoRestart(instanceName, restArguments)
 		return
 	}
+	if command == "rolling-restart" {
+		connection.DoRollingRestart(instanceName, restArguments)
+		return
+	}
+	if command == "logs" {
+		services, backlog, level, follow := parseLogsArguments(restArguments)
+		connection.DoLogs(instanceName, services, backlog, level, follow)
+		return
+	}
+	if command == "reset" {
+		if len(restArguments) == 0 {
+			if instanceName != "web" && instanceName != "webserver" && instanceName != "grpcwebserver" {
+				log.Fatalf("requires service names for this operation")
+			}
+			restArguments = []string{"webserver"}
+		}
+		connection.DoReset(instanceName, restArguments)
+		return
+	}
+	if command == "drain" {
+		connection.DoDrain(instanceName, restArguments)
+		return
+	}
+	if command == "scale" {
+		if len(restArguments) != 2 {
+			log.Fatalf("requires service name and replicas count for this operation")
+		}
+		replicas, err := strconv.Atoi(restArguments[1])
+		if err != nil {
+			log.Fatalf("wrong replicas count %s: %v", restArguments[1], err)
+		}
+		connection.DoScale(instanceName, restArguments[0], replicas)
+		return
+	}
+	if command == "events" {
+		serviceName, limit := parseEventsArguments(instanceName, restArguments)
+		connection.ShowEvents(instanceName, serviceName, limit)
+		return
+	}
+}
+
+func parseEventsArguments(instanceName string, arguments []string) (serviceName string, limit int) {
+	for index := 0; index < len(arguments); index++ {
+		argument := arguments[index]
+		if argument == "-n" {
+			if index+1 >= len(arguments) {
+				log.Fatalf("option %s requires value", argument)
+			}
+			index++
+			value, err := strconv.Atoi(arguments[index])
+			if err != nil {
+				log.Fatalf("wrong events count %s: %v", arguments[index], err)
+			}
+			limit = value
+		} else {
+			serviceName = argument
+		}
+	}
+	if serviceName == "" {
+		if instanceName != "web" && instanceName != "webserver" && instanceName != "grpcwebserver" {
+			log.Fatalf("requires service name for this operation")
+		}
+		serviceName = "webserver"
+	}
+	return
+}
+
+func parseAuditArguments(arguments []string) (instanceName string, since time.Time, limit int) {
+	for index := 0; index < len(arguments); index++ {
+		argument := arguments[index]
+		if argument == "--since" || argument == "-n" {
+			if index+1 >= len(arguments) {
+				log.Fatalf("option %s requires value", argument)
+			}
+			index++
+			if argument == "--since" {
+				since = parseSince(arguments[index])
+			} else if value, err := strconv.Atoi(arguments[index]); err != nil {
+				log.Fatalf("wrong records count %s: %v", arguments[index], err)
+			} else {
+				limit = value
+			}
+		} else {
+			instanceName = argument
+		}
+	}
+	return
+}
+
+// parseSince accepts duration ago or local date with optional time
+func parseSince(value string) time.Time {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration)
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if result, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return result
+		}
+	}
+	log.Fatalf("wrong time %s, expected duration like 2h or YYYY-MM-DD [HH:MM]", value)
+	return time.Time{}
+}
+
+func parseLogsArguments(arguments []string) (services []string, backlog int, level string, follow bool) {
+	backlog = 10
+	services = make([]string, 0, len(arguments))
+	for index := 0; index < len(arguments); index++ {
+		argument := arguments[index]
+		if argument == "-f" || argument == "--follow" {
+			follow = true
+		} else if argument == "-n" || argument == "-l" {
+			if index+1 >= len(arguments) {
+				log.Fatalf("option %s requires value", argument)
+			}
+			index++
+			if argument == "-l" {
+				level = arguments[index]
+			} else if value, err := strconv.Atoi(arguments[index]); err != nil {
+				log.Fatalf("wrong lines count %s: %v", arguments[index], err)
+			} else {
+				backlog = value
+			}
+		} else {
+			services = append(services, argument)
+		}
+	}
+	return
 }
 
 func loadServerConfig(fileName string) (*ServerConfig, error) {
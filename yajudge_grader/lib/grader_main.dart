@@ -31,8 +31,14 @@ Future<GraderService> initializeGrader(ArgResults parsedArguments, bool useLogFi
   else if (identityProperties.name.isNotEmpty) {
     graderInstanceName = identityProperties.name;
   }
+  // replicas of the same grader share configuration but must have
+  // distinct names, working directories and cgroups
+  String graderReplicaName = graderInstanceName;
+  if (parsedArguments['replica'] != null) {
+    graderReplicaName = '$graderInstanceName-${parsedArguments['replica']}';
+  }
   String hostName = io.Platform.localHostname;
-  String graderFullName = '$graderInstanceName@$hostName';
+  String graderFullName = '$graderReplicaName@$hostName';
   identityProperties = GraderIdentityProperties(graderFullName);
 
   print('Using $graderFullName as full grader name');
@@ -44,6 +50,9 @@ Future<GraderService> initializeGrader(ArgResults parsedArguments, bool useLogFi
 
 
   var locationProperties = GraderLocationProperties.fromYamlConfig(config['locations'], graderInstanceName);
+  if (parsedArguments['replica'] != null) {
+    locationProperties.workDir = path.join(locationProperties.workDir, 'replica-${parsedArguments['replica']}');
+  }
   ServiceProperties serviceProperties;
   if (config['service'] is YamlMap) {
     serviceProperties =
@@ -119,7 +128,7 @@ Future<GraderService> initializeGrader(ArgResults parsedArguments, bool useLogFi
 
   if (io.Platform.isLinux) {
     Logger.root.info('Checking for linux cgroup capabilities');
-    String cgroupInitializationError = ChrootedRunner.initializeLinuxCgroup(graderInstanceName);
+    String cgroupInitializationError = ChrootedRunner.initializeLinuxCgroup(graderReplicaName);
     Logger.root.info('Will use cgroup root: ${ChrootedRunner.cgroupRoot}');
     print('Will use cgroup root: ${ChrootedRunner.cgroupRoot}');
     if (cgroupInitializationError.isEmpty) {
@@ -303,6 +312,7 @@ ArgResults parseArguments(List<String> arguments) {
   mainParser.addOption('log', abbr: 'L', help: 'log file name');
   mainParser.addOption('pid', abbr: 'P', help: 'pid file name');
   mainParser.addOption('name', abbr: 'N', help: 'grader name in case of multiple instances running same host');
+  mainParser.addOption('replica', abbr: 'R', help: 'replica number in case of multiple graders running same instance');
 
   final runParser = ArgParser();
   runParser.addOption('limits', abbr: 'l', help: 'custom problem limits');
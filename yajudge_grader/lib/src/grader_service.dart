@@ -1,4 +1,5 @@
 import 'dart:async';
+import 'dart:convert';
 import 'dart:io' as io;
 import 'dart:math';
 
@@ -92,6 +93,10 @@ class GraderService {
   bool shuttingDown = false;
   int shutdownExitCode = 0;
 
+  // draining grader do not take new submissions and exits after current ones
+  bool draining = false;
+  int _submissionsInProgressCount = 0;
+
   int availableWorkersCount = 1;
 
   GraderService({
@@ -108,10 +113,12 @@ class GraderService {
   }) {
     io.ProcessSignal.sigterm.watch().listen((_) => shutdown('SIGTERM'));
     io.ProcessSignal.sigint.watch().listen((_) => shutdown('SIGINT'));
+    io.ProcessSignal.sigusr1.watch().listen((_) => drain('SIGUSR1'));
     io.ProcessSignal.sighup.watch().listen((_) {
       log.info('got SIGHUP, invalidating service connections');
       invalidateServicesConnection();
     });
+    listenControlSocket();
     log.info('estimating performance rating, this will take some time...');
     _performanceRating = estimatePerformanceRating();
     log.info('performance rating: $_performanceRating');
@@ -144,6 +151,33 @@ class GraderService {
     _submissionsServiceConnection = null;
   }
 
+  void listenControlSocket() {
+    // supervisor sends RECONNECT=<endpoint> lines when one of master services restarts
+    final socketPath = io.Platform.environment['YAJUDGE_CONTROL_SOCKET'];
+    if (socketPath == null || socketPath.isEmpty) {
+      return;
+    }
+    final socketFile = io.File(socketPath);
+    if (socketFile.existsSync()) {
+      socketFile.deleteSync();
+    }
+    final address = io.InternetAddress(socketPath, type: io.InternetAddressType.unix);
+    io.ServerSocket.bind(address, 0).then((server) {
+      server.listen((connection) {
+        utf8.decoder.bind(connection).join().then((message) {
+          final lines = LineSplitter.split(message);
+          final reconnectAll = !lines.any((line) => line.startsWith('RECONNECT='));
+          if (reconnectAll || lines.contains('RECONNECT=yajudge.SubmissionManagement')) {
+            log.info('got reconnect message, invalidating service connections');
+            invalidateServicesConnection();
+          }
+        });
+      });
+    }).catchError((error) {
+      log.warning('cant listen control socket $socketPath: $error');
+    });
+  }
+
   static int estimateWorkersCount() {
     return io.Platform.numberOfProcessors;
   }
@@ -330,6 +364,9 @@ class GraderService {
   }
 
   Future<void> serveSubmissionsStream() async {
+    if (draining) {
+      return; // do not take new submissions
+    }
     if (submissionsService == null) {
       return; // not ready to get submissions
     }
@@ -350,10 +387,11 @@ class GraderService {
           continue; // prevent periodical push of the same submission
         }
         waitForAnyWorkerIdle();
-        if (shuttingDown) {
+        if (shuttingDown || draining) {
           return;
         }
         submissionsInProgress.add(submissionId);
+        _submissionsInProgressCount++;
         log.info('processing submission ${submission.id} from master');
         try {
           final result = await processSubmission(submission);
@@ -367,6 +405,7 @@ class GraderService {
         } catch (e) {
           log.severe('error processing submissions ${submission.id}: $e');
         }
+        _submissionsInProgressCount--;
         await pushGraderStatus();
       }
     } catch (error) {
@@ -402,7 +441,7 @@ class GraderService {
     bool pushOK = false;
     while (!shuttingDown && !pushOK) {
       ServiceStatus status = ServiceStatus.SERVICE_STATUS_UNKNOWN;
-      if (shuttingDown) {
+      if (shuttingDown || draining) {
         status = ServiceStatus.SERVICE_STATUS_SHUTTING_DOWN;
       } else {
         status = isIdle()
@@ -528,6 +567,28 @@ class GraderService {
     }
   }
 
+  void drain(String reason) {
+    if (draining || shuttingDown) {
+      return;
+    }
+    log.info('grader draining due to $reason, '
+        '$_submissionsInProgressCount submissions in progress');
+    draining = true;
+    pushGraderStatus();
+    Timer.periodic(Duration(milliseconds: 250), (timer) {
+      if (_submissionsInProgressCount > 0) {
+        return;
+      }
+      timer.cancel();
+      log.info('grader drained, no submissions in progress');
+      final pidFilePath = serviceProperties.pidFilePath;
+      if (pidFilePath != null && io.File(pidFilePath).existsSync()) {
+        io.File(pidFilePath).deleteSync();
+      }
+      io.exit(0);
+    });
+  }
+
   void shutdown(String reason, [bool error = false]) async {
     log.info('grader shutting down due to $reason');
     shuttingDown = true;
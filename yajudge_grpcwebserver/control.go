@@ -0,0 +1,95 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	controlMessageMaxSize = 4096
+	controlMessageTimeout = time.Second
+)
+
+// ControlMessage is sent by supervisor as KEY=VALUE lines
+type ControlMessage struct {
+	Instance    string
+	Service     string
+	Reconnect   []string
+	Maintenance bool
+}
+
+func ParseControlMessage(content string) *ControlMessage {
+	result := &ControlMessage{}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "INSTANCE":
+			result.Instance = value
+		case "SERVICE":
+			result.Service = value
+		case "RECONNECT":
+			result.Reconnect = append(result.Reconnect, value)
+		case "MAINTENANCE":
+			result.Maintenance = true
+		}
+	}
+	return result
+}
+
+// ServeControlSocket accepts control messages from supervisor. Socket is not removed
+// on exit because it might be already taken by replacing webserver process.
+func (server *ServerHandler) ServeControlSocket(socketName string, maintenanceDir string) {
+	os.Remove(socketName)
+	listener, err := net.Listen("unix", socketName)
+	if err != nil {
+		log.Warningf("cant listen control socket %s: %v", socketName, err)
+		return
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Warningf("cant accept control connection: %v", err)
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(controlMessageTimeout))
+			content, err := io.ReadAll(io.LimitReader(conn, controlMessageMaxSize))
+			conn.Close()
+			if err != nil {
+				log.Warningf("cant read control message: %v", err)
+				continue
+			}
+			server.HandleControlMessage(ParseControlMessage(string(content)), maintenanceDir)
+		}
+	}()
+}
+
+func (server *ServerHandler) HandleControlMessage(message *ControlMessage, maintenanceDir string) {
+	if message.Maintenance {
+		server.ReloadMaintenance(maintenanceDir)
+		return
+	}
+	log.WithFields(log.Fields{"instance": message.Instance, "service": message.Service}).
+		Infof("got reconnect message for service %s@%s", message.Service, message.Instance)
+	for _, host := range server.Sites {
+		if host == nil || host.config.Instance != message.Instance {
+			continue
+		}
+		if len(message.Reconnect) == 0 {
+			host.InvalidateEndpointConnections()
+			continue
+		}
+		for _, endpointName := range message.Reconnect {
+			if endpoint := host.endpoints[endpointName]; endpoint != nil {
+				endpoint.InvalidateEndpointConnection()
+			}
+		}
+	}
+}
@@ -7,11 +7,36 @@ import (
 	"github.com/mwitkow/grpc-proxy/proxy"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
 	"strconv"
 	"sync"
 )
 
+// proxiedCall keeps result of proxied call to be logged by request handler
+type proxiedCall struct {
+	code codes.Code
+}
+
+type proxiedCallKey struct{}
+
+// withProxiedCall returns request which proxied call result is recorded for,
+// gRPC server passes request context to call handlers
+func withProxiedCall(req *http.Request) (*http.Request, *proxiedCall) {
+	call := &proxiedCall{code: codes.Unknown}
+	return req.WithContext(context.WithValue(req.Context(), proxiedCallKey{}, call)), call
+}
+
+func recordCallStatus(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, stream)
+	if call, ok := stream.Context().Value(proxiedCallKey{}).(*proxiedCall); ok {
+		call.code = status.Code(err)
+	}
+	return err
+}
+
 type GrpcEndpoint struct {
 	grpcServer    *grpc.Server
 	grpcWebServer *grpcweb.WrappedGrpcServer
@@ -59,7 +84,7 @@ func (endpoint *GrpcEndpoint) CreateEndpointConnection() (err error) {
 
 func (endpoint *GrpcEndpoint) InvalidateEndpointConnection() {
 	go func() {
-		log.Infof("invalidating endpoint connection to %s", endpoint.config.ServiceName)
+		log.WithField("endpoint", endpoint.config.ServiceName).Infof("invalidating endpoint connection to %s", endpoint.config.ServiceName)
 		endpoint.grpcMutex.Lock()
 		endpoint.grpcClient = nil
 		endpoint.grpcMutex.Unlock()
@@ -82,9 +107,9 @@ func (endpoint *GrpcEndpoint) GrpcRedirectHandler(ctx context.Context, method st
 		grpcClient = endpoint.grpcClient
 		endpoint.grpcMutex.RUnlock()
 		if err == nil {
-			log.Printf("connected to gRPC server %v", endpoint.config.ServiceURL)
+			log.WithField("endpoint", endpoint.config.ServiceName).Infof("connected to gRPC server %v", endpoint.config.ServiceURL)
 		} else {
-			log.Warningf("cant connect to gRPC server %v: %v", endpoint.config.ServiceURL, err)
+			log.WithField("endpoint", endpoint.config.ServiceName).Warningf("cant connect to gRPC server %v: %v", endpoint.config.ServiceURL, err)
 		}
 	}
 	return proxyCtx, grpcClient, err
@@ -97,6 +122,7 @@ func NewGrpcEndpoint(config *EndpointConfig) *GrpcEndpoint {
 	}
 	grpcEndpoint.grpcServer = grpc.NewServer(
 		grpc.CustomCodec(proxy.Codec()),
+		grpc.StreamInterceptor(recordCallStatus),
 		grpc.UnknownServiceHandler(proxy.TransparentHandler(grpcEndpoint.GrpcRedirectHandler)),
 	)
 	grpcEndpoint.grpcWebServer = grpcweb.WrapServer(grpcEndpoint.grpcServer)
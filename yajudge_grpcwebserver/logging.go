@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	}
+	return nil, fmt.Errorf("unknown log_format '%s', expected json or text", format)
+}
+
+func logLevel(level string) (log.Level, error) {
+	if level == "" {
+		return log.InfoLevel, nil
+	}
+	return log.ParseLevel(level)
+}
+
+func (config *ServiceConfig) validateLogging() error {
+	if _, err := logFormatter(config.LogFormat); err != nil {
+		return err
+	}
+	_, err := logLevel(config.LogLevel)
+	return err
+}
+
+// configureLogger sets format and level of webserver log
+func (config *ServiceConfig) configureLogger() {
+	if formatter, err := logFormatter(config.LogFormat); err == nil {
+		log.SetFormatter(formatter)
+	}
+	if level, err := logLevel(config.LogLevel); err == nil {
+		log.SetLevel(level)
+	}
+}
+
+// logger returns log entry with fields identifying site
+func (host *Site) logger() *log.Entry {
+	return log.WithFields(log.Fields{"site": host.name, "instance": host.config.Instance})
+}
+
+// requestLogger returns log entry describing proxied request
+func (host *Site) requestLogger(req *http.Request) *log.Entry {
+	return host.logger().WithFields(log.Fields{
+		"remote_addr": req.RemoteAddr,
+		"grpc_method": req.URL.Path,
+	})
+}
+
+// logProxiedCall writes single record for proxied call when it is finished
+func (host *Site) logProxiedCall(req *http.Request, endpoint *GrpcEndpoint, protocol string, call *proxiedCall, duration time.Duration) {
+	host.requestLogger(req).WithFields(log.Fields{
+		"endpoint": endpoint.target,
+		"duration": duration.Seconds(),
+		"status":   call.code.String(),
+	}).Infof("%s requested %v using %s protocol, proxied to %s, finished with %v in %v",
+		req.RemoteAddr,
+		req.URL,
+		protocol,
+		endpoint.target,
+		call.code,
+		duration,
+	)
+}
@@ -39,7 +39,11 @@ func main() {
 	if pidFileName != nil && *pidFileName != "" {
 		config.Service.PidFile = *pidFileName
 	}
+	if config.Service.MaintenanceDir == "" && config.Service.PidFile != "" {
+		config.Service.MaintenanceDir = path.Join(path.Dir(config.Service.PidFile), "maintenance")
+	}
 	initializeLogger(config.Service.LogFile)
+	config.Service.configureLogger()
 	createPIDFile(config.Service.PidFile)
 	log.Infof("starting webserver on pid = %v", os.Getpid())
 	httpListener, httpsListener, err := createListeners(config.Sites, config.Listen)
@@ -50,6 +54,10 @@ func main() {
 	for name, hostConfig := range config.Sites {
 		handler.Sites[name], err = NewHostInstance(name, hostConfig, config.Listen.HttpsPort)
 	}
+	handler.ReloadMaintenance(config.Service.MaintenanceDir)
+	if controlSocket := os.Getenv("YAJUDGE_CONTROL_SOCKET"); controlSocket != "" {
+		handler.ServeControlSocket(controlSocket, config.Service.MaintenanceDir)
+	}
 	http2Server := &http2.Server{
 		IdleTimeout:          15 * time.Minute,
 		MaxConcurrentStreams: 500,
@@ -73,6 +81,7 @@ func main() {
 			<-signalChan
 			log.Infof("got SIGHUP signal")
 			handler.InvalidateEndpointConnections()
+			handler.ReloadMaintenance(config.Service.MaintenanceDir)
 		}
 	}
 	go handleReloadSignal()
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenanceState is written by supervisor while instance is stopped for maintenance
+type MaintenanceState struct {
+	Until   time.Time `json:"until"`
+	Message string    `json:"message"`
+}
+
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Maintenance</title></head>
+<body>
+<h1>Site is under maintenance</h1>
+<p>%s</p>
+<p>Expected to be back at %s.</p>
+</body>
+</html>
+`
+
+// ReloadMaintenance reads maintenance state of sites instances from directory managed by supervisor
+func (server *ServerHandler) ReloadMaintenance(maintenanceDir string) {
+	for _, host := range server.Sites {
+		if host == nil || host.config.Instance == "" || maintenanceDir == "" {
+			continue
+		}
+		var state *MaintenanceState
+		content, err := os.ReadFile(path.Join(maintenanceDir, host.config.Instance))
+		if err == nil {
+			state = &MaintenanceState{}
+			if err := json.Unmarshal(content, state); err != nil {
+				host.logger().Warningf("cant parse maintenance state of %s: %v", host.name, err)
+			}
+		}
+		host.SetMaintenance(state)
+	}
+}
+
+func (host *Site) SetMaintenance(state *MaintenanceState) {
+	host.maintenanceMutex.Lock()
+	defer host.maintenanceMutex.Unlock()
+	if state != nil && host.maintenance == nil {
+		host.logger().Infof("site %s is under maintenance until %v", host.name, state.Until)
+	} else if state == nil && host.maintenance != nil {
+		host.logger().Infof("site %s maintenance is over", host.name)
+	}
+	host.maintenance = state
+}
+
+func (host *Site) Maintenance() *MaintenanceState {
+	host.maintenanceMutex.RLock()
+	defer host.maintenanceMutex.RUnlock()
+	return host.maintenance
+}
+
+// ServeMaintenance responds with 503 to all requests, web pages get maintenance page
+func (host *Site) ServeMaintenance(wr http.ResponseWriter, req *http.Request, state *MaintenanceState) {
+	retryAfter := int(time.Until(state.Until).Seconds())
+	if retryAfter > 0 {
+		wr.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	if req.Method != "GET" || strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(wr, "site is under maintenance", 503)
+		return
+	}
+	var page []byte
+	if host.config.MaintenancePage != "" {
+		var err error
+		if page, err = os.ReadFile(host.config.MaintenancePage); err != nil {
+			host.logger().Warningf("cant read maintenance page of %s: %v", host.name, err)
+		}
+	}
+	if page == nil {
+		message := state.Message
+		if message == "" {
+			message = "Scheduled maintenance is in progress."
+		}
+		page = []byte(fmt.Sprintf(defaultMaintenancePage,
+			html.EscapeString(message), state.Until.Local().Format("2006-01-02 15:04")))
+	}
+	wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+	wr.Header().Set("Cache-Control", "no-store")
+	wr.WriteHeader(503)
+	wr.Write(page)
+}
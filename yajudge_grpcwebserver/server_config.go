@@ -27,11 +27,22 @@ type SiteConfig struct {
 	WebAppStaticMaxAge         int    `yaml:"web_app_static_max_age" json:"web_app_static_max_age"`
 	StaticReloadInterval       int    `yaml:"static_reload_interval" json:"static_reload_interval"`
 	EndpointsFileName          string `yaml:"grpc_endpoints" json:"grpc_endpoints"`
+	// supervisor instance serving the site, name of site configuration directory by default
+	Instance string `yaml:"instance" json:"instance"`
+	// HTML file served while instance is under maintenance, simple page is used if not set
+	MaintenancePage string `yaml:"maintenance_page" json:"maintenance_page"`
 }
 
 type ServiceConfig struct {
 	LogFile string `yaml:"log_file" json:"log_file"`
 	PidFile string `yaml:"pid_file" json:"pid_file"`
+	// supervisor puts maintenance state of instances there,
+	// 'maintenance' next to PID file by default
+	MaintenanceDir string `yaml:"maintenance_dir" json:"maintenance_dir"`
+	// text or json
+	LogFormat string `yaml:"log_format" json:"log_format"`
+	// panic, fatal, error, warning, info, debug or trace
+	LogLevel string `yaml:"log_level" json:"log_level"`
 }
 
 type ListenConfig struct {
@@ -59,6 +70,9 @@ func ParseWebServerConfig(fileName string) (*WebServerConfig, error) {
 	if err := yaml.Unmarshal(confData, &config); err != nil {
 		return nil, err
 	}
+	if err := config.Service.validateLogging(); err != nil {
+		return nil, err
+	}
 	if config.Sites == nil {
 		config.Sites = make(map[string]*SiteConfig)
 	}
@@ -79,6 +93,9 @@ func ParseWebServerConfig(fileName string) (*WebServerConfig, error) {
 				if err != nil {
 					return nil, fmt.Errorf("cant parse site config %s: %v", siteConfFileName, err)
 				}
+				if siteConf.Instance == "" {
+					siteConf.Instance = dirEntry.Name()
+				}
 				config.Sites[siteConf.HostName] = siteConf
 			}
 		}
@@ -105,7 +122,7 @@ func ParseSiteConfig(fileName string) (*SiteConfig, error) {
 		return nil, err
 	}
 	if config.HostName == "" {
-		return nil, fmt.Errorf("does not contains 'host_name'", fileName)
+		return nil, fmt.Errorf("%s does not contains 'host_name'", fileName)
 	}
 	if config.ProxyPass != "" && config.WebAppStaticRoot != "" {
 		msg := fmt.Errorf("must have either non-empty 'wep_app_static_root' or 'proxy_pass' but not both")
@@ -136,6 +153,10 @@ func ParseSiteConfig(fileName string) (*SiteConfig, error) {
 		confRootDir := path.Dir(fileName)
 		config.WebAppStaticRoot = path.Clean(path.Join(confRootDir, config.WebAppStaticRoot))
 	}
+	if config.MaintenancePage != "" && !path.IsAbs(config.MaintenancePage) {
+		confRootDir := path.Dir(fileName)
+		config.MaintenancePage = path.Clean(path.Join(confRootDir, config.MaintenancePage))
+	}
 	endpointConfData, err := ioutil.ReadFile(endpointFileName)
 	if err != nil {
 		return nil, err
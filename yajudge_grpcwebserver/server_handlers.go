@@ -8,6 +8,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Site struct {
@@ -17,6 +19,8 @@ type Site struct {
 	httpsRedirectBase string
 	proxyPassURL      *url.URL
 	endpoints         map[string]*GrpcEndpoint
+	maintenance       *MaintenanceState
+	maintenanceMutex  sync.RWMutex
 }
 
 type ServerHandler struct {
@@ -121,7 +125,7 @@ func (host *Site) Serve(wr http.ResponseWriter, req *http.Request) {
 	isGrpc := !isGrpcWeb && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
 	endpoint := host.FindEndpoint(req)
 	if req.TLS == nil && host.httpsRedirectBase != "" && !isGrpc && !isGrpcWeb {
-		log.Debugf("%s requested %s via http, redirecting to https", req.RemoteAddr, req.URL.Path)
+		host.logger().WithField("remote_addr", req.RemoteAddr).Debugf("%s requested %s via http, redirecting to https", req.RemoteAddr, req.URL.Path)
 		// force using https instead of http in case if http supported by host instance
 		redirectUrl := req.URL
 		redirectUrl.Scheme = "https"
@@ -130,6 +134,10 @@ func (host *Site) Serve(wr http.ResponseWriter, req *http.Request) {
 		http.Redirect(wr, req, redirectString, 302)
 		return
 	}
+	if maintenance := host.Maintenance(); maintenance != nil {
+		host.ServeMaintenance(wr, req, maintenance)
+		return
+	}
 	if req.Method == "POST" && isGrpcWeb && endpoint != nil {
 		// use gRPC-Listen to gGRP package to proxy
 		if endpoint.grpcWebServer == nil {
@@ -137,12 +145,10 @@ func (host *Site) Serve(wr http.ResponseWriter, req *http.Request) {
 			http.Error(wr, errorMessage, 503)
 			return
 		}
-		log.Printf("%s requested %v using gRPC-Web protocol, proxied to %s",
-			req.RemoteAddr,
-			req.URL,
-			endpoint.target,
-		)
+		req, call := withProxiedCall(req)
+		started := time.Now()
 		endpoint.grpcWebServer.ServeHTTP(wr, req)
+		host.logProxiedCall(req, endpoint, "gRPC-Web", call, time.Since(started))
 		return
 	}
 	if req.Method == "POST" && isGrpc && endpoint != nil {
@@ -152,12 +158,10 @@ func (host *Site) Serve(wr http.ResponseWriter, req *http.Request) {
 			http.Error(wr, errorMessage, 503)
 			return
 		}
-		log.Printf("%s requested %v using gRPC protocol, proxied to %s",
-			req.RemoteAddr,
-			req.URL,
-			endpoint.target,
-		)
+		req, call := withProxiedCall(req)
+		started := time.Now()
 		endpoint.grpcServer.ServeHTTP(wr, req)
+		host.logProxiedCall(req, endpoint, "gRPC", call, time.Since(started))
 		return
 	}
 	if host.proxyPassURL != nil {
@@ -172,7 +176,7 @@ func (host *Site) Serve(wr http.ResponseWriter, req *http.Request) {
 			Body:     req.Body,
 			Header:   req.Header,
 		}
-		log.Debugf("%s requested %v, will proxy to %v", req.RemoteAddr, req.URL, *host.proxyPassURL)
+		host.logger().WithField("remote_addr", req.RemoteAddr).Debugf("%s requested %v, will proxy to %v", req.RemoteAddr, req.URL, *host.proxyPassURL)
 		client := http.DefaultClient
 		proxyResponse, err := client.Do(proxyRequest)
 		if err != nil {
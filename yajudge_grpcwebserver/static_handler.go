@@ -112,7 +112,7 @@ func (handler *StaticHandler) loadDirectoryContent(dirPath, prefix string) error
 
 func (handler *StaticHandler) Handle(w http.ResponseWriter, req *http.Request) {
 	reqPath := req.URL.Path
-	log.Debugf("%s requested %s", req.RemoteAddr, reqPath)
+	log.WithField("remote_addr", req.RemoteAddr).Debugf("%s requested %s", req.RemoteAddr, reqPath)
 	if reqPath == "/" {
 		reqPath = "/index.html"
 	}
@@ -13,6 +13,7 @@ import 'dart:io' as io;
 import 'package:path/path.dart' as path;
 
 import 'services_connector.dart';
+import 'socket_activation.dart';
 
 
 abstract class ServiceLauncherBase {
@@ -24,9 +25,17 @@ abstract class ServiceLauncherBase {
   Future<void> stop() async {
     final serviceName = service.$name;
     final endpoint = rpcProperties.endpoints[serviceName]!;
-    if (endpoint.isUnix) {
+    if (endpoint.isUnix && !_socketActivated) {
       final socketFile = io.File(endpoint.unixPath);
-      socketFile.deleteSync();
+      // replacement process started by supervisor rolling restart might
+      // already listen on the same path, so remove only own socket: the one
+      // bound later by replacement has different modification time
+      final socketStat = socketFile.statSync();
+      if (_socketStat != null &&
+          socketStat.type != io.FileSystemEntityType.notFound &&
+          socketStat.modified == _socketStat!.modified) {
+        socketFile.deleteSync();
+      }
     }
   }
 
@@ -49,6 +58,8 @@ abstract class ServiceLauncherBase {
   @protected
   final Map<String,ArgParser> extraArgParsers;
   final Set<String> _notLoggedMethods = {};
+  io.FileStat? _socketStat;
+  bool _socketActivated = false;
   final Set<String> _servicePrivateMethods = {};
   @protected
   late final Service service;
@@ -300,6 +311,38 @@ abstract class ServiceLauncherBase {
     io.ProcessSignal.sigterm.watch().listen((_) => _terminate('SIGTERM'));
     io.ProcessSignal.sigint.watch().listen((_) => _terminate('SIGHUP'));
     io.ProcessSignal.sighup.watch().listen((_) => services.invalidateConnections('SIGHUP'));
+    _listenControlSocket();
+  }
+
+  void _listenControlSocket() {
+    // supervisor sends RECONNECT=<endpoint> lines when one of services restarts
+    final socketPath = io.Platform.environment['YAJUDGE_CONTROL_SOCKET'];
+    if (socketPath == null || socketPath.isEmpty) {
+      return;
+    }
+    final socketFile = io.File(socketPath);
+    if (socketFile.existsSync()) {
+      socketFile.deleteSync();
+    }
+    final address = io.InternetAddress(socketPath, type: io.InternetAddressType.unix);
+    io.ServerSocket.bind(address, 0).then((server) {
+      server.listen((connection) {
+        utf8.decoder.bind(connection).join().then((message) {
+          final endpoints = LineSplitter.split(message)
+              .where((line) => line.startsWith('RECONNECT='))
+              .map((line) => line.substring('RECONNECT='.length))
+              .toList();
+          if (endpoints.isEmpty) {
+            services.invalidateConnections('control message');
+          }
+          for (final endpoint in endpoints) {
+            services.invalidateConnection(endpoint, 'control message');
+          }
+        });
+      });
+    }).catchError((error) {
+      Logger.root.warning('cant listen control socket $socketPath: $error');
+    });
   }
 
   @protected
@@ -312,6 +355,7 @@ abstract class ServiceLauncherBase {
     }
     final grpcServer = Server([service], interceptors);
     dynamic address;
+    final socketFd = endpoint.isUnix ? inheritedSocket() : null;
     if (!endpoint.isUnix) {
       if (endpoint.host.isEmpty) {
         address = io.InternetAddress.anyIPv4;
@@ -321,6 +365,11 @@ abstract class ServiceLauncherBase {
       }
       await grpcServer.serve(address: address, port: endpoint.port, shared: true);
     }
+    else if (socketFd != null) {
+      // socket is owned by supervisor and kept while process restarts
+      _socketActivated = true;
+      await serveInheritedSocket(grpcServer, socketFd);
+    }
     else {
       final unixSocketFile = io.File(endpoint.unixPath);
       if (unixSocketFile.existsSync()) {
@@ -344,6 +393,7 @@ abstract class ServiceLauncherBase {
         io.Process.runSync('chmod', ['0666', unixSocketFile.absolute.path]);
       });
       await grpcServer.serve(address: address);
+      _socketStat = unixSocketFile.statSync();
     }
   }
 
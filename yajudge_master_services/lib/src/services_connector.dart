@@ -183,6 +183,36 @@ class ServicesConnector {
     _submissions = null;
     _users = null;
   }
+
+  void invalidateConnection(String endpointName, String reason) {
+    log.info('invalidating gRPC client connection to $endpointName due to $reason');
+    switch (endpointName) {
+      case 'yajudge.CourseContentProvider':
+        _content = null;
+        break;
+      case 'yajudge.CourseManagement':
+        _courses = null;
+        break;
+      case 'yajudge.DeadlinesManagement':
+        _deadlines = null;
+        break;
+      case 'yajudge.ProgressCalculator':
+        _progress = null;
+        break;
+      case 'yajudge.CodeReviewManagement':
+        _review = null;
+        break;
+      case 'yajudge.SessionManagement':
+        _sessions = null;
+        break;
+      case 'yajudge.SubmissionManagement':
+        _submissions = null;
+        break;
+      case 'yajudge.UserManagement':
+        _users = null;
+        break;
+    }
+  }
 }
 
 class _PrivateServiceClientInterceptor implements ClientInterceptor {
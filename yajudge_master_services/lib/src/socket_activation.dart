@@ -0,0 +1,194 @@
+import 'dart:async';
+import 'dart:ffi';
+import 'dart:io' as io;
+import 'dart:isolate';
+import 'dart:typed_data';
+
+import 'package:ffi/ffi.dart';
+import 'package:grpc/grpc.dart';
+import 'package:http2/transport.dart';
+import 'package:logging/logging.dart';
+
+// Supervisor passes listening socket in systemd style (see sd_listen_fds(3)):
+// descriptors start from 3, LISTEN_PID is set to receiving process pid,
+// LISTEN_FDS contains descriptors count and LISTEN_FDNAMES their names.
+//
+// dart:io can not wrap existing descriptors, so connections are accepted,
+// read and written by blocking libc calls in helper isolates and passed to
+// gRPC server as HTTP/2 transport streams.
+
+const _listenFdsStart = 3;
+const _bufferSize = 64 * 1024;
+const _eintr = 4;
+const _shutRdWr = 2;
+
+final _libc = DynamicLibrary.process();
+final _accept = _libc.lookupFunction<
+    Int32 Function(Int32, Pointer<Void>, Pointer<Void>),
+    int Function(int, Pointer<Void>, Pointer<Void>)>('accept');
+final _read = _libc.lookupFunction<
+    IntPtr Function(Int32, Pointer<Uint8>, IntPtr),
+    int Function(int, Pointer<Uint8>, int)>('read');
+final _write = _libc.lookupFunction<
+    IntPtr Function(Int32, Pointer<Uint8>, IntPtr),
+    int Function(int, Pointer<Uint8>, int)>('write');
+final _shutdown = _libc.lookupFunction<
+    Int32 Function(Int32, Int32),
+    int Function(int, int)>('shutdown');
+final _close = _libc.lookupFunction<
+    Int32 Function(Int32),
+    int Function(int)>('close');
+final _errnoLocation = _libc.lookupFunction<
+    Pointer<Int32> Function(),
+    Pointer<Int32> Function()>('__errno_location');
+
+int _errno() => _errnoLocation().value;
+
+/// Returns listening socket descriptor inherited from supervisor
+/// or null if process was started without socket activation
+int? inheritedSocket() {
+  final environment = io.Platform.environment;
+  if (environment['LISTEN_PID'] != '${io.pid}') {
+    return null;
+  }
+  final count = int.tryParse(environment['LISTEN_FDS'] ?? '') ?? 0;
+  if (count != 1) {
+    // service launcher serves exactly one gRPC service
+    return null;
+  }
+  final name = environment['LISTEN_FDNAMES'] ?? '';
+  Logger.root.info('using socket $name passed by supervisor as descriptor $_listenFdsStart');
+  return _listenFdsStart;
+}
+
+/// Serves gRPC requests on inherited listening socket
+Future<void> serveInheritedSocket(Server grpcServer, int listenFd) async {
+  final connections = ReceivePort();
+  connections.listen((message) {
+    if (message is int) {
+      _serveConnection(grpcServer, message);
+    }
+    else {
+      Logger.root.shout('cant accept connection on inherited socket: $message');
+      connections.close();
+      io.exit(1);
+    }
+  });
+  await Isolate.spawn(_acceptLoop, [listenFd, connections.sendPort]);
+}
+
+void _serveConnection(Server grpcServer, int fd) {
+  final incoming = StreamController<List<int>>();
+  final outgoing = StreamController<List<int>>();
+  // descriptor is closed when both reader and writer isolates finished
+  // to prevent them from using number reused by next accepted connection
+  var activeLoops = 2;
+  void loopFinished() {
+    activeLoops--;
+    if (activeLoops == 0) {
+      _close(fd);
+    }
+  }
+
+  final reader = ReceivePort();
+  reader.listen((message) {
+    if (message is Uint8List) {
+      incoming.add(message);
+    }
+    else {
+      reader.close();
+      incoming.close();
+      loopFinished();
+    }
+  });
+  final writer = ReceivePort();
+  writer.listen((message) {
+    if (message is SendPort) {
+      outgoing.stream.listen(message.send,
+        onDone: () => message.send(null),
+        onError: (_) => message.send(null),
+        cancelOnError: true,
+      );
+    }
+    else {
+      writer.close();
+      loopFinished();
+    }
+  });
+  Isolate.spawn(_readLoop, [fd, reader.sendPort]);
+  Isolate.spawn(_writeLoop, [fd, writer.sendPort]);
+  final connection = ServerTransportConnection.viaStreams(incoming.stream, outgoing.sink);
+  grpcServer.serveConnection(connection);
+}
+
+void _acceptLoop(List<dynamic> arguments) {
+  final listenFd = arguments[0] as int;
+  final connections = arguments[1] as SendPort;
+  while (true) {
+    final fd = _accept(listenFd, nullptr, nullptr);
+    if (fd >= 0) {
+      connections.send(fd);
+    }
+    else if (_errno() != _eintr) {
+      connections.send('accept error ${_errno()}');
+      return;
+    }
+  }
+}
+
+void _readLoop(List<dynamic> arguments) {
+  final fd = arguments[0] as int;
+  final chunks = arguments[1] as SendPort;
+  final buffer = malloc<Uint8>(_bufferSize);
+  while (true) {
+    final count = _read(fd, buffer, _bufferSize);
+    if (count < 0 && _errno() == _eintr) {
+      continue;
+    }
+    if (count <= 0) {
+      break;
+    }
+    chunks.send(Uint8List.fromList(buffer.asTypedList(count)));
+  }
+  malloc.free(buffer);
+  chunks.send(null);
+}
+
+void _writeLoop(List<dynamic> arguments) {
+  final fd = arguments[0] as int;
+  final finished = arguments[1] as SendPort;
+  final chunks = ReceivePort();
+  final buffer = malloc<Uint8>(_bufferSize);
+  chunks.listen((chunk) {
+    if (chunk is List<int> && _writeAll(fd, chunk, buffer)) {
+      return;
+    }
+    // wakes up reader blocked on this connection
+    _shutdown(fd, _shutRdWr);
+    malloc.free(buffer);
+    chunks.close();
+    finished.send(null);
+  });
+  finished.send(chunks.sendPort);
+}
+
+bool _writeAll(int fd, List<int> data, Pointer<Uint8> buffer) {
+  var offset = 0;
+  while (offset < data.length) {
+    final end = offset + _bufferSize < data.length ? offset + _bufferSize : data.length;
+    buffer.asTypedList(end - offset).setRange(0, end - offset, data, offset);
+    var written = 0;
+    while (written < end - offset) {
+      final count = _write(fd, buffer.elementAt(written), end - offset - written);
+      if (count < 0 && _errno() == _eintr) {
+        continue;
+      }
+      if (count <= 0) {
+        return false;
+      }
+      written += count;
+    }
+    offset = end;
+  }
+  return true;
+}
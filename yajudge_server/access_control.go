@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type accessLevel int
+
+const (
+	accessStatus accessLevel = iota + 1
+	accessControl
+	accessAdmin
+)
+
+var accessLevels = map[string]accessLevel{
+	"status":  accessStatus,
+	"control": accessControl,
+	"admin":   accessAdmin,
+}
+
+// methodAccess is access level required to call supervisor method,
+// methods not listed here require admin access
+var methodAccess = map[string]accessLevel{
+	"GetSupervisorStatus": accessStatus,
+	"GetStatus":           accessStatus,
+	"StreamLogs":          accessStatus,
+	"GetServiceEvents":    accessStatus,
+	"Start":               accessControl,
+	"Stop":                accessControl,
+	"Reset":               accessControl,
+	"Scale":               accessControl,
+	"Drain":               accessControl,
+	"WatchStatus":         accessStatus,
+	"RollingRestart":      accessControl,
+	"Reload":              accessAdmin,
+	"GetAuditLog":         accessStatus,
+}
+
+type AccessRuleConf struct {
+	// user names or numeric uids
+	Users []string `yaml:"users" json:"users"`
+	// group names or numeric gids, supplementary groups of caller are also matched
+	Groups []string `yaml:"groups" json:"groups"`
+	// common names of remote API client certificates
+	Certificates []string `yaml:"certificates" json:"certificates"`
+	// status, control (also start, stop, reset, scale and restart) or admin
+	Access string `yaml:"access" json:"access"`
+	// instances the rule applies to, all instances if empty
+	Instances []string `yaml:"instances" json:"instances"`
+}
+
+func (config *ServerConfig) validateAccessPolicy() error {
+	for index, rule := range config.AccessPolicy {
+		if _, valid := accessLevels[rule.Access]; !valid {
+			return fmt.Errorf("access policy rule %d: unknown access '%s'", index+1, rule.Access)
+		}
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 && len(rule.Certificates) == 0 {
+			return fmt.Errorf("access policy rule %d: no users, groups or certificates set", index+1)
+		}
+	}
+	return nil
+}
+
+// peerCredentials is identity of process connected to supervisor unix socket
+type peerCredentials struct {
+	credentials.CommonAuthInfo
+	Uid    int
+	Gid    int
+	Pid    int
+	Groups []int
+}
+
+func (info peerCredentials) AuthType() string {
+	return "peercred"
+}
+
+// peerCredentialsTransport reads SO_PEERCRED of accepted unix socket
+// connections, it does not change connection data
+type peerCredentialsTransport struct{}
+
+func (transport peerCredentialsTransport) ClientHandshake(ctx context.Context, authority string,
+	conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, fmt.Errorf("peer credentials are used only by server")
+}
+
+func (transport peerCredentialsTransport) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, isUnix := conn.(*net.UnixConn)
+	if !isUnix {
+		return conn, nil, fmt.Errorf("not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return conn, nil, err
+	}
+	var ucred *syscall.Ucred
+	var credError error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credError = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credError
+	}
+	if err != nil {
+		return conn, nil, fmt.Errorf("cant get peer credentials: %v", err)
+	}
+	info := peerCredentials{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		Uid:            int(ucred.Uid),
+		Gid:            int(ucred.Gid),
+		Pid:            int(ucred.Pid),
+		Groups:         processGroups(int(ucred.Pid)),
+	}
+	return conn, info, nil
+}
+
+func (transport peerCredentialsTransport) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (transport peerCredentialsTransport) Clone() credentials.TransportCredentials {
+	return transport
+}
+
+func (transport peerCredentialsTransport) OverrideServerName(string) error {
+	return nil
+}
+
+// processGroups returns supplementary groups of running process
+func processGroups(pid int) []int {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		groups := make([]int, 0)
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if gid, err := strconv.Atoi(field); err == nil {
+				groups = append(groups, gid)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+func matchesUser(names []string, uid int) bool {
+	for _, name := range names {
+		if id, err := strconv.Atoi(name); err == nil {
+			if id == uid {
+				return true
+			}
+		} else if account, err := user.Lookup(name); err == nil && account.Uid == strconv.Itoa(uid) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGroup(names []string, gids []int) bool {
+	for _, name := range names {
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			group, err := user.LookupGroup(name)
+			if err != nil {
+				continue
+			}
+			id, _ = strconv.Atoi(group.Gid)
+		}
+		if slices.Contains(gids, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *AccessRuleConf) matches(caller credentials.AuthInfo) bool {
+	switch info := caller.(type) {
+	case peerCredentials:
+		return matchesUser(rule.Users, info.Uid) || matchesGroup(rule.Groups, append([]int{info.Gid}, info.Groups...))
+	case credentials.TLSInfo:
+		name := certificateName(info)
+		return name != "" && slices.Contains(rule.Certificates, name)
+	}
+	return false
+}
+
+// requestInstanceName returns instance which request is targeted to,
+// all webserver aliases are treated as instance named webserver
+func requestInstanceName(request interface{}) string {
+	scoped, isScoped := request.(interface{ GetInstanceName() string })
+	if !isScoped {
+		return ""
+	}
+	instanceName := scoped.GetInstanceName()
+	if instanceName == "web" || instanceName == "grpcwebserver" {
+		instanceName = "webserver"
+	}
+	return instanceName
+}
+
+// callerName describes caller in logs and errors
+func callerName(caller credentials.AuthInfo) string {
+	switch info := caller.(type) {
+	case peerCredentials:
+		return fmt.Sprintf("uid %d", info.Uid)
+	case credentials.TLSInfo:
+		return fmt.Sprintf("certificate '%s'", certificateName(info))
+	}
+	return "unknown caller"
+}
+
+// authorize checks caller against access policy from server.yaml. Local root
+// and supervisor user are allowed everything, as well as any local caller if
+// there is no policy. Remote callers are allowed only by rules with certificates.
+func (service *SupervisorService) authorize(ctx context.Context, fullMethod string, request interface{}) error {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	callerPeer, peerFound := peer.FromContext(ctx)
+	if !peerFound {
+		return status.Errorf(codes.PermissionDenied, "unknown caller of %s", method)
+	}
+	caller := callerPeer.AuthInfo
+	policy := service.config().AccessPolicy
+	if local, isLocal := caller.(peerCredentials); isLocal {
+		if len(policy) == 0 || local.Uid == 0 || local.Uid == os.Getuid() {
+			return nil
+		}
+	}
+	required, known := methodAccess[method]
+	if !known {
+		required = accessAdmin
+	}
+	instanceName := requestInstanceName(request)
+	for _, rule := range policy {
+		if accessLevels[rule.Access] < required || !rule.matches(caller) {
+			continue
+		}
+		if len(rule.Instances) == 0 || slices.Contains(rule.Instances, instanceName) {
+			return nil
+		}
+		// rule limited to instances allows requests without instance,
+		// which are applied to all instances, only to list instances
+		if instanceName == "" && method == "GetSupervisorStatus" {
+			return nil
+		}
+	}
+	target := ""
+	if instanceName != "" {
+		target = " for instance " + instanceName
+	}
+	log.Warningf("denied %s%s to %s from %v", method, target, callerName(caller), callerPeer.Addr)
+	return status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s%s", callerName(caller), method, target)
+}
+
+func (service *SupervisorService) authorizeUnary(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := service.authorize(ctx, info.FullMethod, request); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+// authorizedStream checks access when streaming call request is received
+type authorizedStream struct {
+	grpc.ServerStream
+	service    *SupervisorService
+	fullMethod string
+}
+
+func (stream *authorizedStream) RecvMsg(message interface{}) error {
+	if err := stream.ServerStream.RecvMsg(message); err != nil {
+		return err
+	}
+	return stream.service.authorize(stream.Context(), stream.fullMethod, message)
+}
+
+func (service *SupervisorService) authorizeStream(server interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(server, &authorizedStream{ServerStream: stream, service: service, fullMethod: info.FullMethod})
+}
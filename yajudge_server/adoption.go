@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	adoptedProcessPollInterval = 250 * time.Millisecond
+	// supervisor exits keeping services running and is started again
+	// by systemd on this signal, SIGTERM keeps services but exits normally
+	keepServicesSignal   = syscall.SIGUSR2
+	keepServicesExitCode = 75
+	// pipe buffer keeps output written while supervisor is restarting
+	outputFifoSize   = 1024 * 1024
+	fcntlSetPipeSize = 1031 // F_SETPIPE_SZ
+)
+
+type ProcessAdoptionConf struct {
+	// keep services running when supervisor exits on SIGTERM or SIGUSR2 and adopt them on next start
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// running processes are stored here on exit, <pid dir>/supervisor.state by default
+	StateFile string `yaml:"state_file" json:"state_file"`
+}
+
+type serviceState struct {
+	InstanceName      string `json:"instance_name"`
+	ServiceName       string `json:"service_name"`
+	Executable        string `json:"executable"`
+	Pid               int    `json:"pid"`
+	ProcessStartTicks int64  `json:"process_start_ticks"`
+	StartTime         int64  `json:"start_time"`
+	CrashesSinceStart int    `json:"crashes_since_start"`
+	RestartAttempts   int    `json:"restart_attempts"`
+}
+
+type supervisorState struct {
+	Services []serviceState `json:"services"`
+}
+
+// SetProcessAdoption makes service processes survive supervisor exit. Their output
+// goes through named pipes instead of anonymous ones, takes effect on next start.
+func (service *Service) SetProcessAdoption(enabled bool) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.ProcessAdoption = enabled
+}
+
+func (service *Service) outputFifoNames() (stdout, stderr string) {
+	base := strings.TrimSuffix(service.PidFile, ".pid")
+	return base + ".stdout", base + ".stderr"
+}
+
+// openOutputFifo creates named pipe for process output. Besides writer end
+// process gets extra reader end to be kept open, so writing to pipe do not
+// fail while supervisor restarts. Nobody reads pipe meanwhile, so process
+// blocks on output if it writes more than pipe buffer holds (enlarged to
+// outputFifoSize if allowed by /proc/sys/fs/pipe-max-size) before new
+// supervisor starts.
+func openOutputFifo(fileName string) (reader, writer, keeper *os.File, err error) {
+	if stat, statError := os.Stat(fileName); statError == nil && stat.Mode()&os.ModeNamedPipe == 0 {
+		os.Remove(fileName)
+	}
+	if err = syscall.Mkfifo(fileName, 0o660); err != nil && !os.IsExist(err) {
+		return nil, nil, nil, fmt.Errorf("cant create pipe %s: %v", fileName, err)
+	}
+	if reader, err = os.OpenFile(fileName, os.O_RDONLY|syscall.O_NONBLOCK, 0); err != nil {
+		return nil, nil, nil, err
+	}
+	if keeper, err = os.OpenFile(fileName, os.O_RDONLY|syscall.O_NONBLOCK, 0); err != nil {
+		reader.Close()
+		return nil, nil, nil, err
+	}
+	if writer, err = os.OpenFile(fileName, os.O_WRONLY, 0); err != nil {
+		reader.Close()
+		keeper.Close()
+		return nil, nil, nil, err
+	}
+	// smaller default buffer is kept if size is not allowed
+	syscall.Syscall(syscall.SYS_FCNTL, writer.Fd(), fcntlSetPipeSize, outputFifoSize)
+	return reader, writer, keeper, nil
+}
+
+// openOutputPipes returns pipes for process stdout and stderr and files
+// to be inherited by process in addition to standard ones
+func (service *Service) openOutputPipes() (stdoutReader, stdoutWriter, stderrReader, stderrWriter *os.File, extraFiles []*os.File, err error) {
+	service.mutex.RLock()
+	processAdoption := service.ProcessAdoption && service.PidFile != ""
+	service.mutex.RUnlock()
+	if !processAdoption {
+		stdoutReader, stdoutWriter, _ = os.Pipe()
+		stderrReader, stderrWriter, _ = os.Pipe()
+		return stdoutReader, stdoutWriter, stderrReader, stderrWriter, nil, nil
+	}
+	stdoutFifo, stderrFifo := service.outputFifoNames()
+	stdoutReader, stdoutWriter, stdoutKeeper, err := openOutputFifo(stdoutFifo)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	stderrReader, stderrWriter, stderrKeeper, err := openOutputFifo(stderrFifo)
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		stdoutKeeper.Close()
+		return nil, nil, nil, nil, nil, err
+	}
+	return stdoutReader, stdoutWriter, stderrReader, stderrWriter, []*os.File{stdoutKeeper, stderrKeeper}, nil
+}
+
+// readProcessExecutable returns executable path of running process,
+// it is still known if executable was replaced by upgrade
+func readProcessExecutable(pid int) (string, error) {
+	executable, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(executable, " (deleted)"), nil
+}
+
+// verifyProcess checks that pid still belongs to the process stored in state
+func verifyProcess(state serviceState) error {
+	stat, err := readProcessStat(state.Pid)
+	if err != nil || stat.state == 'Z' || stat.state == 'X' {
+		return fmt.Errorf("process %d is not running", state.Pid)
+	}
+	if stat.startTicks != state.ProcessStartTicks {
+		return fmt.Errorf("pid %d belongs to another process", state.Pid)
+	}
+	executable, err := readProcessExecutable(state.Pid)
+	if err != nil {
+		return fmt.Errorf("cant check executable of process %d: %v", state.Pid, err)
+	}
+	expected, err := filepath.EvalSymlinks(state.Executable)
+	if err != nil {
+		expected = state.Executable
+	}
+	if executable == expected {
+		return nil
+	}
+	// scripts are run by interpreter which gets script name as first argument
+	commandLine, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", state.Pid))
+	arguments := strings.Split(string(commandLine), "\x00")
+	if len(arguments) > 1 && arguments[1] == state.Executable {
+		return nil
+	}
+	return fmt.Errorf("process %d runs %s instead of %s", state.Pid, executable, expected)
+}
+
+// waitAdoptedProcess blocks until process which is not supervisor child finishes
+func waitAdoptedProcess(pid int, startTicks int64) {
+	for {
+		stat, err := readProcessStat(pid)
+		if err != nil || stat.startTicks != startTicks || stat.state == 'Z' || stat.state == 'X' {
+			return
+		}
+		time.Sleep(adoptedProcessPollInterval)
+	}
+}
+
+// state returns running process description to be adopted after supervisor restart
+func (service *Service) state() (serviceState, bool) {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	if service.Status != ServiceStatus_RUNNING || service.process == nil {
+		return serviceState{}, false
+	}
+	stat, err := readProcessStat(service.process.Pid)
+	if err != nil {
+		return serviceState{}, false
+	}
+	return serviceState{
+		InstanceName:      service.InstanceName,
+		ServiceName:       service.ServiceName,
+		Executable:        service.Executable,
+		Pid:               service.process.Pid,
+		ProcessStartTicks: stat.startTicks,
+		StartTime:         service.StartTime,
+		CrashesSinceStart: service.CrashesSinceStart,
+		RestartAttempts:   service.restartAttempts,
+	}, true
+}
+
+// Adopt continues monitoring of process started by previous supervisor run
+func (service *Service) Adopt(state serviceState) error {
+	if err := verifyProcess(state); err != nil {
+		return err
+	}
+	process, _ := os.FindProcess(state.Pid)
+	service.openLogWriter()
+	stdoutFifo, stderrFifo := service.outputFifoNames()
+	outputCapture := &sync.WaitGroup{}
+	service.mutex.Lock()
+	service.process = process
+	service.adoptedStartTicks = state.ProcessStartTicks
+	service.Error = ""
+	service.StartTime = state.StartTime
+	service.CrashesSinceStart = state.CrashesSinceStart
+	service.restartAttempts = state.RestartAttempts
+	service.healthState = HealthState_HEALTH_UNKNOWN
+	service.failedProbes = 0
+	service.resetNotifications()
+	// adopted process was ready before supervisor restart
+	service.readyPid = state.Pid
+	service.stderrTail = nil
+	service.outputCapture = outputCapture
+	service.setStatus(ServiceStatus_RUNNING)
+	service.mutex.Unlock()
+	// adopted process still sends notifications to socket of the same name
+	if _, err := service.openNotifySocket(); err != nil {
+		service.logger().Warningf("notifications of service %s@%s are lost: %v", service.ServiceName, service.InstanceName, err)
+	}
+	for _, fifo := range []string{stdoutFifo, stderrFifo} {
+		reader, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			service.logger().Warningf("output of service %s@%s is lost: %v", service.ServiceName, service.InstanceName, err)
+			continue
+		}
+		outputCapture.Add(1)
+		go service.captureOutput(reader, outputCapture, fifo == stderrFifo)
+	}
+	service.recordEvent(&ServiceEvent{
+		Type:    ServiceEventType_EVENT_STARTED,
+		Pid:     int32(state.Pid),
+		Message: "adopted after supervisor restart",
+	})
+	go service.checkFilesPermissions()
+	go service.monitorProcess()
+	service.startHealthMonitor()
+	service.startWatchdogMonitor()
+	return nil
+}
+
+// allServices returns webserver and services of all instances
+func (service *SupervisorService) allServices() []*Service {
+	result := []*Service{service.WebServer}
+	for _, instance := range service.instancesList() {
+		for _, instanceService := range instance.services() {
+			result = append(result, instanceService)
+		}
+	}
+	return result
+}
+
+// saveState stores running processes to be adopted on next supervisor start
+func (service *SupervisorService) saveState() {
+	stateFile := service.config().ProcessAdoption.StateFile
+	state := supervisorState{Services: make([]serviceState, 0)}
+	for _, target := range service.allServices() {
+		if processState, running := target.state(); running {
+			state.Services = append(state.Services, processState)
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(stateFile, data, 0o660)
+	}
+	if err != nil {
+		log.Errorf("cant save state to %s, services will not be adopted: %v", stateFile, err)
+		return
+	}
+	log.Infof("saved %d running services to %s", len(state.Services), stateFile)
+}
+
+// adoptProcesses takes running processes stored by previous supervisor run,
+// processes of services not configured anymore are terminated
+func (service *SupervisorService) adoptProcesses() {
+	stateFile := service.config().ProcessAdoption.StateFile
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("cant read state file %s: %v", stateFile, err)
+		}
+		return
+	}
+	// state is valid only for one supervisor start
+	os.Remove(stateFile)
+	state := supervisorState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Warningf("cant parse state file %s: %v", stateFile, err)
+		return
+	}
+	for _, processState := range state.Services {
+		var target *Service
+		if processState.InstanceName == "" && processState.ServiceName == "webserver" {
+			target = service.WebServer
+		} else if instance, instanceFound := service.getInstance(processState.InstanceName); instanceFound {
+			target = instance.service(processState.ServiceName)
+		}
+		if target == nil {
+			if err := verifyProcess(processState); err == nil {
+				log.Warningf("terminating process %d of service %s@%s which is not configured anymore",
+					processState.Pid, processState.ServiceName, processState.InstanceName)
+				syscall.Kill(processState.Pid, syscall.SIGTERM)
+			}
+			continue
+		}
+		if err := target.Adopt(processState); err != nil {
+			log.Warningf("cant adopt service %s@%s: %v", processState.ServiceName, processState.InstanceName, err)
+			continue
+		}
+		target.logger().WithField("pid", processState.Pid).Infof("adopted service %s@%s running with pid %v",
+			processState.ServiceName, processState.InstanceName, processState.Pid)
+	}
+}
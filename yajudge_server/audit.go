@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecordsLimit is max records returned by one call, it keeps
+// response within gRPC message size limit
+const auditRecordsLimit = 1000
+
+// auditEntry is one line of audit log file
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// supervisor method called
+	Method string `json:"method"`
+	// uid and pid of local caller, -1 for remote callers
+	Uid         int      `json:"uid"`
+	Pid         int      `json:"pid"`
+	Certificate string   `json:"certificate,omitempty"`
+	RemoteAddr  string   `json:"remote_addr,omitempty"`
+	Instance    string   `json:"instance,omitempty"`
+	Services    []string `json:"services,omitempty"`
+	// "ok" or error returned to caller
+	Result string `json:"result"`
+}
+
+// auditMutex keeps lines of concurrent calls from being interleaved
+var auditMutex sync.Mutex
+
+// isAudited returns whether method changes supervisor state, methods not known
+// by access policy are treated as mutating ones
+func isAudited(fullMethod string) bool {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	required, known := methodAccess[method]
+	return !known || required > accessStatus
+}
+
+// requestServiceNames returns services which request is targeted to
+func requestServiceNames(request interface{}) []string {
+	if scoped, isScoped := request.(interface{ GetServiceNames() []string }); isScoped {
+		return scoped.GetServiceNames()
+	}
+	if scoped, isScoped := request.(interface{ GetServiceName() string }); isScoped && scoped.GetServiceName() != "" {
+		return []string{scoped.GetServiceName()}
+	}
+	return nil
+}
+
+func newAuditEntry(ctx context.Context, fullMethod string, request interface{}, callError error) *auditEntry {
+	entry := &auditEntry{
+		Time:     time.Now(),
+		Method:   fullMethod[strings.LastIndex(fullMethod, "/")+1:],
+		Uid:      -1,
+		Pid:      -1,
+		Instance: requestInstanceName(request),
+		Services: requestServiceNames(request),
+		Result:   "ok",
+	}
+	if callError != nil {
+		callStatus := status.Convert(callError)
+		entry.Result = fmt.Sprintf("%v: %s", callStatus.Code(), callStatus.Message())
+	}
+	if callerPeer, peerFound := peer.FromContext(ctx); peerFound {
+		switch info := callerPeer.AuthInfo.(type) {
+		case peerCredentials:
+			entry.Uid = info.Uid
+			entry.Pid = info.Pid
+		case credentials.TLSInfo:
+			entry.Certificate = certificateName(info)
+			entry.RemoteAddr = callerPeer.Addr.String()
+		}
+	}
+	return entry
+}
+
+// audit appends record of mutating call to audit log file
+func (service *SupervisorService) audit(entry *auditEntry) {
+	fileName := service.config().AuditLogFile
+	content, _ := json.Marshal(entry)
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	os.MkdirAll(path.Dir(fileName), 0o775)
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		log.Errorf("cant open audit log %s: %v", fileName, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		log.Errorf("cant write audit log %s: %v", fileName, err)
+	}
+}
+
+func (service *SupervisorService) auditUnary(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !isAudited(info.FullMethod) {
+		return handler(ctx, request)
+	}
+	response, err := handler(ctx, request)
+	service.audit(newAuditEntry(ctx, info.FullMethod, request, err))
+	return response, err
+}
+
+// auditedStream keeps request of streaming call to be recorded after call is finished
+type auditedStream struct {
+	grpc.ServerStream
+	request interface{}
+}
+
+func (stream *auditedStream) RecvMsg(message interface{}) error {
+	err := stream.ServerStream.RecvMsg(message)
+	if err == nil && stream.request == nil {
+		stream.request = message
+	}
+	return err
+}
+
+func (service *SupervisorService) auditStream(server interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !isAudited(info.FullMethod) {
+		return handler(server, stream)
+	}
+	audited := &auditedStream{ServerStream: stream}
+	err := handler(server, audited)
+	service.audit(newAuditEntry(stream.Context(), info.FullMethod, audited.request, err))
+	return err
+}
+
+// GetAuditLog returns most recent records of mutating calls made since given time,
+// response is marked truncated if older records are omitted due to limit
+func (service *SupervisorService) GetAuditLog(ctx context.Context, request *AuditRequest) (*AuditResponse, error) {
+	instanceName := requestInstanceName(request)
+	limit := int(request.Limit)
+	if limit <= 0 || limit > auditRecordsLimit {
+		limit = auditRecordsLimit
+	}
+	file, err := os.Open(service.config().AuditLogFile)
+	if os.IsNotExist(err) {
+		return &AuditResponse{}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "cant read audit log: %v", err)
+	}
+	defer file.Close()
+	result := &AuditResponse{Records: make([]*AuditRecord, 0)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		if entry.Time.Unix() < request.Since || (instanceName != "" && entry.Instance != instanceName) {
+			continue
+		}
+		if len(result.Records) == limit {
+			result.Records = result.Records[1:]
+			result.Truncated = true
+		}
+		result.Records = append(result.Records, &AuditRecord{
+			Time:         entry.Time.Unix(),
+			Method:       entry.Method,
+			Uid:          int32(entry.Uid),
+			Pid:          int32(entry.Pid),
+			Certificate:  entry.Certificate,
+			RemoteAddr:   entry.RemoteAddr,
+			InstanceName: entry.Instance,
+			ServiceNames: entry.Services,
+			Result:       entry.Result,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	cpuMaxPeriod     = 100000
+	cgroupMountPoint = "/sys/fs/cgroup"
+	supervisorCgroup = "supervisor"
+	// instance cgroups are grouped apart from supervisor and webserver ones
+	// to allow any instance names
+	instancesCgroup = "instances"
+	procSelfCgroup  = "/proc/self/cgroup"
+)
+
+var memoryMaxPattern = regexp.MustCompile(`^(max|[0-9]+[KMGT]?)$`)
+
+// Controllers to be delegated to service cgroups if available
+var serviceCgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+type ResourceLimitsConf struct {
+	// bytes, might have K, M or G suffix
+	MemoryMax string `yaml:"memory_max" json:"memory_max"`
+	// either percent of one CPU like "150%" or raw "quota period" value
+	CpuMax  string `yaml:"cpu_max" json:"cpu_max"`
+	PidsMax int    `yaml:"pids_max" json:"pids_max"`
+}
+
+func (limits ResourceLimitsConf) validate() error {
+	if !memoryMaxPattern.MatchString(limits.MemoryMax) && limits.MemoryMax != "" {
+		return fmt.Errorf("wrong memory_max value %s", limits.MemoryMax)
+	}
+	if limits.CpuMax != "" && !strings.HasSuffix(limits.CpuMax, "%") {
+		// raw value is "$MAX [$PERIOD]" written to cpu.max as is
+		parts := strings.Fields(limits.CpuMax)
+		if len(parts) < 1 || len(parts) > 2 {
+			return fmt.Errorf("wrong cpu_max value %s", limits.CpuMax)
+		}
+		if quota, err := strconv.Atoi(parts[0]); parts[0] != "max" && (err != nil || quota <= 0) {
+			return fmt.Errorf("wrong cpu_max value %s", limits.CpuMax)
+		}
+		if len(parts) == 2 {
+			if period, err := strconv.Atoi(parts[1]); err != nil || period < 1000 || period > 1000000 {
+				return fmt.Errorf("wrong cpu_max period %s, must be 1000..1000000", parts[1])
+			}
+		}
+	}
+	if limits.PidsMax < 0 {
+		return fmt.Errorf("wrong pids_max value %d", limits.PidsMax)
+	}
+	_, err := limits.cgroupValues()
+	return err
+}
+
+// validateResourceLimits checks limits while loading configuration,
+// so wrong values are not found only when cgroup is prepared
+func validateResourceLimits(limits map[string]ResourceLimitsConf) error {
+	for serviceName, serviceLimits := range limits {
+		if err := serviceLimits.validate(); err != nil {
+			return fmt.Errorf("wrong resource limits of service %s: %v", serviceName, err)
+		}
+	}
+	return nil
+}
+
+func (limits ResourceLimitsConf) cgroupValues() (map[string]string, error) {
+	result := map[string]string{
+		"memory.max": "max",
+		"cpu.max":    "max",
+		"pids.max":   "max",
+	}
+	if limits.MemoryMax != "" {
+		result["memory.max"] = limits.MemoryMax
+	}
+	if strings.HasSuffix(limits.CpuMax, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(limits.CpuMax, "%"))
+		if err != nil || percent <= 0 {
+			return nil, fmt.Errorf("wrong cpu_max value %s", limits.CpuMax)
+		}
+		result["cpu.max"] = fmt.Sprintf("%d %d", percent*cpuMaxPeriod/100, cpuMaxPeriod)
+	} else if limits.CpuMax != "" {
+		result["cpu.max"] = limits.CpuMax
+	}
+	if limits.PidsMax > 0 {
+		result["pids.max"] = strconv.Itoa(limits.PidsMax)
+	}
+	return result, nil
+}
+
+// serviceCgroupPath returns cgroup of service below cgroup root, which is
+// <root>/instances/<instance>/<service> for instance services and
+// <root>/webserver for webserver. Empty string returned if cgroup v2
+// is not available at root.
+func serviceCgroupPath(cgroupRoot, instanceName, serviceName string) string {
+	if cgroupRoot == "" {
+		return ""
+	}
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return ""
+	}
+	if instanceName == "" {
+		return path.Join(cgroupRoot, serviceName)
+	}
+	return path.Join(cgroupRoot, instancesCgroup, instanceName, serviceName)
+}
+
+// ownCgroup returns cgroup v2 directory of supervisor process
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", fmt.Errorf("cant read %s: %v", procSelfCgroup, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return path.Join(cgroupMountPoint, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("supervisor is not in cgroup v2 hierarchy")
+}
+
+// delegatedCgroupRoot returns cgroup of supervisor systemd unit delegated
+// by Delegate=yes, so services belong to the unit and are killed with it
+// when supervisor crashes. Supervisor itself might be already placed into
+// its leaf cgroup by DelegateSubgroup= (systemd 254 or later) or moved
+// there by vacateCgroupRoot with older systemd.
+func delegatedCgroupRoot() (string, error) {
+	cgroupPath, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	if path.Base(cgroupPath) == supervisorCgroup {
+		cgroupPath = path.Dir(cgroupPath)
+	}
+	return cgroupPath, nil
+}
+
+// vacateCgroupRoot moves supervisor from cgroup root into leaf cgroup
+// if it is there, because cgroup having processes can not delegate
+// controllers to its children
+func vacateCgroupRoot(cgroupRoot string) error {
+	cgroupPath, err := ownCgroup()
+	if err != nil || path.Clean(cgroupPath) != path.Clean(cgroupRoot) {
+		return nil
+	}
+	leaf := path.Join(cgroupRoot, supervisorCgroup)
+	if err := os.MkdirAll(leaf, 0o775); err != nil {
+		return fmt.Errorf("cant create cgroup %s: %v", leaf, err)
+	}
+	return moveToCgroup(leaf, os.Getpid())
+}
+
+// serviceResourceLimits returns limits from instance configuration if
+// present or defaults from server configuration otherwise
+func serviceResourceLimits(globalConfig *ServerConfig, config *SupervisorConfig, serviceName string) ResourceLimitsConf {
+	if config != nil {
+		if limits, present := config.ResourceLimits[serviceName]; present {
+			return limits
+		}
+	}
+	return globalConfig.ResourceLimits[serviceName]
+}
+
+// prepareCgroup creates service cgroup below cgroup root, delegates
+// controllers down the hierarchy and applies resource limits
+func prepareCgroup(cgroupRoot, cgroupPath string, limits ResourceLimitsConf) error {
+	values, err := limits.cgroupValues()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cgroupPath, 0o775); err != nil {
+		return fmt.Errorf("cant create cgroup %s: %v", cgroupPath, err)
+	}
+	if err := vacateCgroupRoot(cgroupRoot); err != nil {
+		return err
+	}
+	relativePath := strings.TrimPrefix(strings.TrimPrefix(cgroupPath, cgroupRoot), "/")
+	parent := cgroupRoot
+	for _, part := range strings.Split(relativePath, "/") {
+		if err := enableSubtreeControllers(parent); err != nil {
+			return err
+		}
+		parent = path.Join(parent, part)
+	}
+	for fileName, value := range values {
+		controlFile := path.Join(cgroupPath, fileName)
+		if _, err := os.Stat(controlFile); os.IsNotExist(err) {
+			if value != "max" {
+				log.Warningf("cant apply %s = %s: controller not available in %s", fileName, value, cgroupPath)
+			}
+			continue
+		}
+		if err := os.WriteFile(controlFile, []byte(value), 0); err != nil {
+			return fmt.Errorf("cant write %s to %s: %v", value, controlFile, err)
+		}
+	}
+	return nil
+}
+
+func enableSubtreeControllers(cgroupPath string) error {
+	controllersData, err := os.ReadFile(path.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cant read available controllers of cgroup %s: %v", cgroupPath, err)
+	}
+	available := strings.Fields(string(controllersData))
+	subtreeControl := make([]string, 0, len(serviceCgroupControllers))
+	for _, controller := range serviceCgroupControllers {
+		for _, availableController := range available {
+			if controller == availableController {
+				subtreeControl = append(subtreeControl, "+"+controller)
+			}
+		}
+	}
+	if len(subtreeControl) == 0 {
+		return nil
+	}
+	subtreeControlFile := path.Join(cgroupPath, "cgroup.subtree_control")
+	value := strings.Join(subtreeControl, " ")
+	if err := os.WriteFile(subtreeControlFile, []byte(value), 0); err != nil {
+		return fmt.Errorf("cant write %s to %s: %v", value, subtreeControlFile, err)
+	}
+	return nil
+}
+
+func moveToCgroup(cgroupPath string, pid int) error {
+	procsFile := path.Join(cgroupPath, "cgroup.procs")
+	if err := os.WriteFile(procsFile, []byte(strconv.Itoa(pid)), 0); err != nil {
+		return fmt.Errorf("cant move process %d into cgroup %s: %v", pid, cgroupPath, err)
+	}
+	return nil
+}
+
+// openCgroup prepares service cgroup and returns its directory to start
+// process right inside it, so nothing forked by process escapes limits.
+// Failure is not fatal, so service keeps running without limits.
+func (service *Service) openCgroup() *os.File {
+	service.mutex.RLock()
+	cgroupRoot := service.CgroupRoot
+	cgroupPath := service.CgroupPath
+	limits := service.ResourceLimits
+	service.mutex.RUnlock()
+	if cgroupPath == "" {
+		return nil
+	}
+	err := prepareCgroup(cgroupRoot, cgroupPath, limits)
+	var cgroupDir *os.File
+	if err == nil {
+		cgroupDir, err = os.Open(cgroupPath)
+	}
+	if err != nil {
+		service.logger().Warningf("service %s@%s running without resource limits: %v",
+			service.ServiceName, service.InstanceName, err)
+		return nil
+	}
+	return cgroupDir
+}
+
+// attachCgroup places already started process into service cgroup,
+// used if kernel can not start process inside cgroup (before Linux 5.7)
+func (service *Service) attachCgroup(pid int) {
+	service.mutex.RLock()
+	cgroupPath := service.CgroupPath
+	service.mutex.RUnlock()
+	if err := moveToCgroup(cgroupPath, pid); err != nil {
+		service.logger().Warningf("service %s@%s running without resource limits: %v",
+			service.ServiceName, service.InstanceName, err)
+	}
+}
+
+func (service *Service) SetCgroup(cgroupRoot, cgroupPath string) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.CgroupRoot = cgroupRoot
+	service.CgroupPath = cgroupPath
+}
+
+// SetResourceLimits changes service limits, they are applied immediately
+// if service is running
+func (service *Service) SetResourceLimits(limits ResourceLimitsConf) {
+	service.mutex.Lock()
+	changed := service.ResourceLimits != limits
+	service.ResourceLimits = limits
+	running := service.process != nil
+	cgroupRoot := service.CgroupRoot
+	cgroupPath := service.CgroupPath
+	service.mutex.Unlock()
+	if changed && running && cgroupPath != "" {
+		if err := prepareCgroup(cgroupRoot, cgroupPath, limits); err != nil {
+			service.logger().Warningf("cant apply new resource limits to service %s@%s: %v",
+				service.ServiceName, service.InstanceName, err)
+		}
+	}
+}
+
+func (service *Service) removeCgroup() {
+	service.mutex.RLock()
+	cgroupPath := service.CgroupPath
+	service.mutex.RUnlock()
+	if cgroupPath != "" {
+		// fails if cgroup still has processes, that is ok
+		os.Remove(cgroupPath)
+	}
+}
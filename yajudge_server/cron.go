@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is parsed cron expression of five fields: minute, hour,
+// day of month, month and day of week, matched against local time
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// day matches if either day of month or day of week matches when both are restricted
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// cronSearchLimit is how far next matching time is searched for expressions like "0 0 30 2 *"
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+func parseCron(expression string) (*cronSchedule, error) {
+	if alias, isAlias := cronAliases[expression]; isAlias {
+		expression = alias
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", expression)
+	}
+	result := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	var err error
+	if result.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("wrong minute in '%s': %v", expression, err)
+	}
+	if result.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("wrong hour in '%s': %v", expression, err)
+	}
+	if result.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("wrong day of month in '%s': %v", expression, err)
+	}
+	if result.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("wrong month in '%s': %v", expression, err)
+	}
+	if result.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("wrong day of week in '%s': %v", expression, err)
+	}
+	// both 0 and 7 are Sunday
+	if result.weekdays&(1<<7) != 0 {
+		result.weekdays |= 1
+	}
+	return result, nil
+}
+
+// parseCronField parses comma separated list of values, ranges and steps like "*/15" or "1-5,0"
+func parseCronField(field string, min, max int) (uint64, error) {
+	var result uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeExpression, stepExpression, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepExpression); err != nil || step < 1 {
+				return 0, fmt.Errorf("wrong step '%s'", stepExpression)
+			}
+		}
+		first, last := min, max
+		if rangeExpression != "*" {
+			firstExpression, lastExpression, isRange := strings.Cut(rangeExpression, "-")
+			var err error
+			if first, err = strconv.Atoi(firstExpression); err != nil {
+				return 0, fmt.Errorf("wrong value '%s'", firstExpression)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(lastExpression); err != nil {
+					return 0, fmt.Errorf("wrong value '%s'", lastExpression)
+				}
+			} else if hasStep {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", item, min, max)
+		}
+		for value := first; value <= last; value += step {
+			result |= 1 << value
+		}
+	}
+	return result, nil
+}
+
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	if schedule.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dayMatches := schedule.days&(1<<t.Day()) != 0
+	weekdayMatches := schedule.weekdays&(1<<int(t.Weekday())) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return dayMatches && weekdayMatches
+	}
+	return dayMatches || weekdayMatches
+}
+
+func (schedule *cronSchedule) matches(t time.Time) bool {
+	return schedule.dayMatches(t) &&
+		schedule.hours&(1<<t.Hour()) != 0 &&
+		schedule.minutes&(1<<t.Minute()) != 0
+}
+
+// next returns first matching minute after given time
+func (schedule *cronSchedule) next(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(cronSearchLimit)
+	for t.Before(limit) {
+		if !schedule.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.hours&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.minutes&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
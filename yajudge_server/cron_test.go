@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2023, month, day, hour, minute, 0, 0, time.Local)
+	}
+	// March 1, 2023 is Wednesday
+	tests := []struct {
+		expression string
+		after      time.Time
+		expected   time.Time
+		found      bool
+	}{
+		{"*/15 * * * *", at(time.March, 1, 10, 7), at(time.March, 1, 10, 15), true},
+		{"*/15 * * * *", at(time.March, 1, 10, 15), at(time.March, 1, 10, 30), true},
+		{"*/15 * * * *", at(time.March, 1, 10, 45), at(time.March, 1, 11, 0), true},
+		{"10-50/20 * * * *", at(time.March, 1, 10, 31), at(time.March, 1, 10, 50), true},
+		// Saturday is skipped
+		{"0 9 * * 1-5,0", at(time.March, 3, 10, 0), at(time.March, 5, 9, 0), true},
+		{"0 9 * * 1-5,0", at(time.March, 5, 10, 0), at(time.March, 6, 9, 0), true},
+		// both 0 and 7 are Sunday
+		{"0 0 * * 7", at(time.March, 1, 0, 0), at(time.March, 5, 0, 0), true},
+		{"0 0 * * 0", at(time.March, 1, 0, 0), at(time.March, 5, 0, 0), true},
+		// restricted day of month and day of week match either
+		{"0 0 13 * 5", at(time.March, 1, 0, 0), at(time.March, 3, 0, 0), true},
+		{"0 0 13 * 5", at(time.March, 11, 0, 0), at(time.March, 13, 0, 0), true},
+		{"0 0 13 * *", at(time.March, 1, 0, 0), at(time.March, 13, 0, 0), true},
+		{"@daily", at(time.March, 31, 12, 0), at(time.April, 1, 0, 0), true},
+		{"@monthly", at(time.December, 15, 0, 0), time.Date(2024, time.January, 1, 0, 0, 0, 0, time.Local), true},
+		{"0 0 29 2 *", at(time.March, 1, 0, 0), time.Date(2024, time.February, 29, 0, 0, 0, 0, time.Local), true},
+		// never matches, search stops at limit
+		{"0 0 30 2 *", at(time.March, 1, 0, 0), time.Time{}, false},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.expression)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expression, err)
+			continue
+		}
+		next, found := schedule.next(test.after)
+		if found != test.found || !next.Equal(test.expected) {
+			t.Errorf("%q after %v: got %v, %v, expected %v, %v",
+				test.expression, test.after, next, found, test.expected, test.found)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	expressions := []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@never",
+	}
+	for _, expression := range expressions {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("parseCron(%q) succeeded, expected error", expression)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainSignal asks service to stop taking new jobs and exit after in-flight ones are finished
+const drainSignal = syscall.SIGUSR1
+
+// SetDrainTimeout enables drain before stop for services supporting it
+func (service *Service) SetDrainTimeout(drainTimeout int) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.DrainTimeout = drainTimeout
+}
+
+// drain sends drain signal to running service and waits for process exit,
+// returns false if process is still running after timeout
+func (service *Service) drain(timeout time.Duration) (bool, error) {
+	service.mutex.Lock()
+	process := service.process
+	if service.Status != ServiceStatus_RUNNING && service.Status != ServiceStatus_UNHEALTHY || process == nil {
+		serviceStatus := service.Status
+		service.mutex.Unlock()
+		return false, fmt.Errorf("service is %v", serviceStatus)
+	}
+	service.setStatus(ServiceStatus_DRAINING)
+	service.mutex.Unlock()
+	service.logger().WithField("pid", process.Pid).Infof("draining service %s@%s (pid=%v) for at most %v",
+		service.ServiceName, service.InstanceName, process.Pid, timeout)
+	if err := process.Signal(drainSignal); err != nil {
+		return false, err
+	}
+	// status is changed by process monitor when drained process exits
+	deadline := time.Now().Add(timeout)
+	for {
+		service.mutex.RLock()
+		serviceStatus := service.Status
+		service.mutex.RUnlock()
+		if serviceStatus != ServiceStatus_DRAINING {
+			return serviceStatus == ServiceStatus_STOPPED, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(readinessProbeInterval)
+	}
+}
+
+// Drain finishes service gracefully without terminating it, service keeps
+// draining if its jobs are not finished within drain timeout
+func (service *Service) Drain() error {
+	service.mutex.RLock()
+	drainTimeout := time.Duration(service.DrainTimeout) * time.Second
+	service.mutex.RUnlock()
+	if drainTimeout <= 0 {
+		return fmt.Errorf("drain is not supported or disabled")
+	}
+	drained, err := service.drain(drainTimeout)
+	if err != nil {
+		return err
+	}
+	if !drained {
+		return fmt.Errorf("not drained within %v, still finishing jobs", drainTimeout)
+	}
+	return nil
+}
+
+// stopGraders stops grader replicas at the same time as each one might drain for a long time
+func stopGraders(graders []*Service) {
+	var stopped sync.WaitGroup
+	for _, grader := range graders {
+		stopped.Add(1)
+		go func(grader *Service) {
+			grader.Stop()
+			stopped.Done()
+		}(grader)
+	}
+	stopped.Wait()
+}
+
+func (service *SupervisorService) Drain(ctx context.Context, request *DrainRequest) (*StatusResponse, error) {
+	instance, instanceFound := service.getInstance(request.InstanceName)
+	if !instanceFound {
+		return nil, status.Errorf(codes.NotFound, "instance %s not found", request.InstanceName)
+	}
+	names := request.ServiceNames
+	if len(names) == 0 {
+		names = []string{graderServiceName}
+	}
+	for _, serviceName := range names {
+		if instance.service(serviceName) == nil {
+			return nil, status.Errorf(codes.NotFound, "service %s not found in instance %s", serviceName, request.InstanceName)
+		}
+	}
+	names = instance.expandServiceNames(names)
+	errors := make([]error, len(names))
+	var drained sync.WaitGroup
+	for index, serviceName := range names {
+		drained.Add(1)
+		go func(index int, target *Service) {
+			if err := target.Drain(); err != nil {
+				errors[index] = fmt.Errorf("%s: %v", target.ServiceName, err)
+			}
+			drained.Done()
+		}(index, instance.service(serviceName))
+	}
+	drained.Wait()
+	for _, err := range errors {
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "cant drain %v", err)
+		}
+	}
+	return &StatusResponse{
+		InstanceName:    request.InstanceName,
+		ServiceStatuses: instance.GetServiceStatuses(),
+	}, nil
+}
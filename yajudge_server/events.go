@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// events recorded during this period are persisted by single write,
+// so crash loops do not rewrite history file on each event
+const eventsSaveDelay = time.Second
+
+type EventHistoryConf struct {
+	// max events kept per service
+	Size int `yaml:"size" json:"size"`
+	// last lines of stderr attached to exit events
+	StderrLines int `yaml:"stderr_lines" json:"stderr_lines"`
+	// store history in <service>.events files next to logs to keep it across restarts
+	Persist bool `yaml:"persist" json:"persist"`
+}
+
+// eventHistory is a bounded ring of service lifecycle events
+type eventHistory struct {
+	config   EventHistoryConf
+	fileName string
+	events   []*ServiceEvent
+	start    int
+	loaded   bool
+	// save is scheduled but history is not captured yet
+	savePending bool
+	// orders writes of captured histories
+	saveMutex sync.Mutex
+}
+
+func (history *eventHistory) list() []*ServiceEvent {
+	result := make([]*ServiceEvent, 0, len(history.events))
+	result = append(result, history.events[history.start:]...)
+	result = append(result, history.events[:history.start]...)
+	return result
+}
+
+func (history *eventHistory) add(event *ServiceEvent) {
+	if history.config.Size <= 0 {
+		return
+	}
+	if len(history.events) < history.config.Size {
+		history.events = append(history.events, event)
+	} else {
+		history.events[history.start] = event
+		history.start = (history.start + 1) % len(history.events)
+	}
+}
+
+func (history *eventHistory) resize(size int) {
+	events := history.list()
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+	history.events = events
+	history.start = 0
+	history.config.Size = size
+}
+
+func (history *eventHistory) load() {
+	history.loaded = true
+	if !history.config.Persist {
+		return
+	}
+	data, err := os.ReadFile(history.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("cant read events history %s: %v", history.fileName, err)
+		}
+		return
+	}
+	stored := &EventsResponse{}
+	if err := protojson.Unmarshal(data, stored); err != nil {
+		log.Warningf("cant parse events history %s: %v", history.fileName, err)
+		return
+	}
+	for _, event := range stored.Events {
+		history.add(event)
+	}
+}
+
+// snapshot returns serialized history to be written by saveEventHistory
+func (history *eventHistory) snapshot() ([]byte, error) {
+	return protojson.Marshal(&EventsResponse{Events: history.list()})
+}
+
+func saveEventHistory(fileName string, data []byte) {
+	tempFileName := fileName + ".tmp"
+	err := os.WriteFile(tempFileName, data, 0o660)
+	if err == nil {
+		err = os.Rename(tempFileName, fileName)
+	}
+	if err != nil {
+		log.Warningf("cant save events history %s: %v", fileName, err)
+	}
+}
+
+// SetEventHistory configures service events history, events stored
+// on disk are loaded on first call if persistence enabled
+func (service *Service) SetEventHistory(config EventHistoryConf) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	history := &service.events
+	history.fileName = strings.TrimSuffix(service.LogFile, ".log") + ".events"
+	persist := history.config.Persist
+	if config.Size != history.config.Size {
+		history.resize(config.Size)
+	}
+	history.config = config
+	if !history.loaded || (config.Persist && !persist) {
+		history.load()
+	}
+}
+
+func (service *Service) recordEvent(event *ServiceEvent) {
+	event.Timestamp = time.Now().Unix()
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.events.add(event)
+	if service.events.config.Persist && !service.events.savePending {
+		service.events.savePending = true
+		time.AfterFunc(eventsSaveDelay, service.persistEvents)
+	}
+}
+
+// persistEvents writes events history outside of service mutex,
+// so slow disk does not block status and health checks
+func (service *Service) persistEvents() {
+	history := &service.events
+	history.saveMutex.Lock()
+	defer history.saveMutex.Unlock()
+	service.mutex.Lock()
+	history.savePending = false
+	fileName := history.fileName
+	data, err := history.snapshot()
+	service.mutex.Unlock()
+	if err != nil {
+		log.Warningf("cant save events history %s: %v", fileName, err)
+		return
+	}
+	saveEventHistory(fileName, data)
+}
+
+// exitEvent describes finished process, uptime is taken from current start time
+func (service *Service) exitEvent(eventType ServiceEventType, pid int, processState *os.ProcessState) *ServiceEvent {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	event := &ServiceEvent{
+		Type:       eventType,
+		Pid:        int32(pid),
+		Uptime:     time.Now().Unix() - service.StartTime,
+		StderrTail: append([]string{}, service.stderrTail...),
+	}
+	if processState == nil {
+		// exit status of adopted process is not known
+		event.ExitCode = -1
+		return event
+	}
+	event.ExitCode = int32(processState.ExitCode())
+	if waitStatus, ok := processState.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+		event.Signal = waitStatus.Signal().String()
+		event.CoreDumped = waitStatus.CoreDump()
+	}
+	return event
+}
+
+// rememberStderr keeps last lines of stderr to be attached to exit event
+func (service *Service) rememberStderr(line string) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	limit := service.events.config.StderrLines
+	if limit <= 0 {
+		return
+	}
+	service.stderrTail = append(service.stderrTail, strings.TrimSuffix(line, "\n"))
+	if len(service.stderrTail) > limit {
+		service.stderrTail = service.stderrTail[len(service.stderrTail)-limit:]
+	}
+}
+
+func (service *SupervisorService) GetServiceEvents(ctx context.Context, request *EventsRequest) (*EventsResponse, error) {
+	if request.ServiceName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "service name required")
+	}
+	services, err := service.findServices(request.InstanceName, []string{request.ServiceName})
+	if err != nil {
+		return nil, err
+	}
+	target := services[0]
+	target.mutex.RLock()
+	events := target.events.list()
+	target.mutex.RUnlock()
+	if request.Limit > 0 && len(events) > int(request.Limit) {
+		events = events[len(events)-int(request.Limit):]
+	}
+	return &EventsResponse{Events: events}, nil
+}
@@ -1,6 +1,6 @@
 module yajudge_server
 
-go 1.18
+go 1.20
 
 require (
 	github.com/ghodss/yaml v1.0.0
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	graderServiceName = "grader"
+	maxGraderReplicas = 64
+)
+
+// graderReplicaName returns "grader" for first replica to keep
+// its log and pid files names compatible and "grader-N" for others
+func graderReplicaName(replica int) string {
+	if replica <= 1 {
+		return graderServiceName
+	}
+	return fmt.Sprintf("%s-%d", graderServiceName, replica)
+}
+
+func isGraderService(serviceName string) bool {
+	if serviceName == graderServiceName {
+		return true
+	}
+	suffix := strings.TrimPrefix(serviceName, graderServiceName+"-")
+	if suffix == serviceName {
+		return false
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil
+}
+
+// baseServiceName returns name used to find service configuration,
+// all grader replicas share the same one
+func baseServiceName(serviceName string) string {
+	if isGraderService(serviceName) {
+		return graderServiceName
+	}
+	return serviceName
+}
+
+func (instance *Instance) newGraderReplica(replica int, initialStatus ServiceStatus) *Service {
+	config := instance.config()
+	globalConfig := instance.globalConfig()
+	serviceName := graderReplicaName(replica)
+	grader := NewService(
+		instance.Name,
+		serviceName,
+		globalConfig.ServiceExecutables[graderServiceName],
+		path.Join(globalConfig.LogFileDir, instance.Name, serviceName+".log"),
+		path.Join(globalConfig.PidFileDir, instance.Name, serviceName+".pid"),
+		"",
+		initialStatus,
+		serviceRestartPolicy(globalConfig, config, graderServiceName),
+		globalConfig.HealthCheck,
+		globalConfig.LogRotation,
+		globalConfig.ShutdownTimeout,
+		instance.exitHandler,
+	)
+	grader.Replica = replica
+	instance.configureService(grader)
+	return grader
+}
+
+// graderReplicas returns grader services ordered by replica number
+func (instance *Instance) graderReplicas() []*Service {
+	result := make([]*Service, 0, 1)
+	for serviceName, service := range instance.services() {
+		if isGraderService(serviceName) {
+			result = append(result, service)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Replica < result[j].Replica
+	})
+	return result
+}
+
+// Scale starts or stops grader replicas to match required count.
+// New replicas are started only if first one is running.
+func (instance *Instance) Scale(replicas int) error {
+	if replicas < 1 || replicas > maxGraderReplicas {
+		return fmt.Errorf("replicas count must be in range 1..%d", maxGraderReplicas)
+	}
+	instance.scaleMutex.Lock()
+	defer instance.scaleMutex.Unlock()
+	current := instance.graderReplicas()
+	firstStatus := current[0].GetStatus().Status
+	if replicas > len(current) {
+		initialStatus := ServiceStatus_STOPPED
+		if firstStatus == ServiceStatus_DISABLED {
+			initialStatus = ServiceStatus_DISABLED
+		}
+		added := make([]*Service, 0, replicas-len(current))
+		for replica := len(current) + 1; replica <= replicas; replica++ {
+			added = append(added, instance.newGraderReplica(replica, initialStatus))
+		}
+		instance.mutex.Lock()
+		for _, grader := range added {
+			instance.Services[grader.ServiceName] = grader
+		}
+		instance.mutex.Unlock()
+		instance.logger().Infof("instance %s scaled up to %d graders", instance.Name, replicas)
+		if firstStatus == ServiceStatus_RUNNING {
+			for _, grader := range added {
+				grader.Start()
+			}
+		}
+	} else if replicas < len(current) {
+		removed := current[replicas:]
+		for _, grader := range removed {
+			grader.Stop()
+		}
+		instance.mutex.Lock()
+		for _, grader := range removed {
+			delete(instance.Services, grader.ServiceName)
+		}
+		instance.mutex.Unlock()
+		instance.logger().Infof("instance %s scaled down to %d graders", instance.Name, replicas)
+	}
+	return nil
+}
+
+func (service *SupervisorService) Scale(ctx context.Context, request *ScaleRequest) (*StatusResponse, error) {
+	if request.ServiceName != graderServiceName {
+		return nil, status.Errorf(codes.InvalidArgument, "only %s might be scaled", graderServiceName)
+	}
+	instance, instanceFound := service.getInstance(request.InstanceName)
+	if !instanceFound {
+		return nil, status.Errorf(codes.NotFound, "instance %s not found", request.InstanceName)
+	}
+	if err := instance.Scale(int(request.Replicas)); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cant scale %s: %v", request.ServiceName, err)
+	}
+	return &StatusResponse{
+		InstanceName:    request.InstanceName,
+		ServiceStatuses: instance.GetServiceStatuses(),
+	}, nil
+}
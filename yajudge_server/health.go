@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"os"
+	"syscall"
+	"time"
+)
+
+// probeSocket checks that service accepts gRPC connections on unix socket
+// and reports SERVING by grpc.health.v1 protocol. Services not implementing
+// health protocol are considered healthy if connection handshake succeeded.
+func probeSocket(sockFile string, timeout time.Duration) (time.Duration, error) {
+	if _, err := os.Stat(sockFile); err != nil {
+		return 0, fmt.Errorf("no socket %s", sockFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	probeStart := time.Now()
+	conn, err := grpc.DialContext(ctx, "unix://"+sockFile,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("cant connect to %s: %v", sockFile, err)
+	}
+	defer conn.Close()
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	latency := time.Since(probeStart)
+	if status.Code(err) == codes.Unimplemented {
+		return latency, nil
+	}
+	if err != nil {
+		return latency, fmt.Errorf("health check failed: %v", err)
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return latency, fmt.Errorf("health check status is %v", response.Status)
+	}
+	return latency, nil
+}
+
+func (service *Service) startHealthMonitor() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.SockFile == "" || service.healthMonitorActive {
+		return
+	}
+	service.healthMonitorActive = true
+	go service.monitorHealth()
+}
+
+func (service *Service) monitorHealth() {
+	for {
+		service.mutex.RLock()
+		healthCheck := service.HealthCheck
+		service.mutex.RUnlock()
+		time.Sleep(time.Duration(healthCheck.IntervalMs) * time.Millisecond)
+		timeout := time.Duration(healthCheck.TimeoutMs) * time.Millisecond
+		startPeriod := int64(healthCheck.StartPeriodSec)
+		service.mutex.RLock()
+		serviceStatus := service.Status
+		startTime := service.StartTime
+		everServed := service.healthState == HealthState_HEALTH_SERVING
+		service.mutex.RUnlock()
+		if serviceStatus == ServiceStatus_RESPAWNING || serviceStatus == ServiceStatus_UNHEALTHY {
+			continue
+		}
+		if serviceStatus != ServiceStatus_RUNNING {
+			break
+		}
+		latency, err := probeSocket(service.SockFile, timeout)
+		service.mutex.Lock()
+		if service.Status != ServiceStatus_RUNNING || service.StartTime != startTime {
+			// state changed while probing, so result is not actual
+			service.mutex.Unlock()
+			continue
+		}
+		service.probeLatency = latency
+		if err == nil {
+			service.healthState = HealthState_HEALTH_SERVING
+			service.failedProbes = 0
+			service.mutex.Unlock()
+			continue
+		}
+		inStartPeriod := !everServed && time.Now().Unix()-startTime < startPeriod
+		if inStartPeriod {
+			service.mutex.Unlock()
+			continue
+		}
+		service.healthState = HealthState_HEALTH_NOT_SERVING
+		service.failedProbes++
+		failedProbes := service.failedProbes
+		if failedProbes < healthCheck.FailureThreshold {
+			service.mutex.Unlock()
+			service.logger().Warningf("health probe of service %s@%s failed (%v of %v): %v",
+				service.ServiceName, service.InstanceName, failedProbes, healthCheck.FailureThreshold, err)
+			continue
+		}
+		service.Error = err.Error()
+		service.setStatus(ServiceStatus_UNHEALTHY)
+		process := service.process
+		service.mutex.Unlock()
+		service.eventLogger(ServiceEventType_EVENT_KILLED_UNHEALTHY, processPid(process)).Warningf("service %s@%s is unhealthy after %v failed probes, killing it to restart: %v",
+			service.ServiceName, service.InstanceName, failedProbes, err)
+		service.recordEvent(&ServiceEvent{
+			Type:    ServiceEventType_EVENT_KILLED_UNHEALTHY,
+			Message: err.Error(),
+		})
+		if process != nil {
+			// process exit will be handled by monitorProcess under restart policy
+			process.Signal(syscall.SIGKILL)
+		}
+	}
+	service.mutex.Lock()
+	service.healthMonitorActive = false
+	service.mutex.Unlock()
+}
@@ -1,86 +1,291 @@
 package main
 
 import (
-	log "github.com/sirupsen/logrus"
+	"fmt"
 	"golang.org/x/exp/slices"
 	"os"
 	"path"
+	"reflect"
 	"sort"
+	"sync"
 	"time"
 )
 
 type Instance struct {
+	Name         string
 	GlobalConfig *ServerConfig
 	Config       *SupervisorConfig
-	Grader       *Service
-	Services     map[string]*Service
+	// first grader replica
+	Grader   *Service
+	Services map[string]*Service
 
-	exitHandler NotifyFunc
+	mutex         sync.RWMutex
+	scaleMutex    sync.Mutex
+	exitHandler   NotifyFunc
+	statusHandler StatusFunc
+	// instance is kept stopped until end of maintenance window
+	maintenanceUntil time.Time
 }
 
-func NewInstance(globalConfig *ServerConfig, config *SupervisorConfig, exitHandler NotifyFunc) *Instance {
-	var graderInitialStatus ServiceStatus
-	if config.AutostartGrader {
-		graderInitialStatus = ServiceStatus_STOPPED
-	} else {
-		graderInitialStatus = ServiceStatus_DISABLED
-	}
+func NewInstance(globalConfig *ServerConfig, config *SupervisorConfig, exitHandler NotifyFunc, statusHandler StatusFunc) *Instance {
 	result := &Instance{
-		GlobalConfig: globalConfig,
-		Config:       config,
-		Grader: NewService(
-			config.InstanceName,
-			"grader",
-			globalConfig.ServiceExecutables["grader"],
-			path.Join(globalConfig.LogFileDir, config.InstanceName, "grader.log"),
-			path.Join(globalConfig.PidFileDir, config.InstanceName, "grader.pid"),
-			"",
-			graderInitialStatus,
-			globalConfig.RestartPolicy,
-			globalConfig.ShutdownTimeout,
-			exitHandler,
-		),
-		exitHandler: exitHandler,
+		Name:          config.InstanceName,
+		GlobalConfig:  globalConfig,
+		Config:        config,
+		exitHandler:   exitHandler,
+		statusHandler: statusHandler,
 	}
 	result.CreateServices()
 	return result
 }
 
 func (instance *Instance) CreateServices() {
-	os.MkdirAll(path.Join(instance.GlobalConfig.LogFileDir, instance.Config.InstanceName), 0o770)
-	os.MkdirAll(path.Join(instance.GlobalConfig.PidFileDir, instance.Config.InstanceName), 0o770)
-	masterServices := []string{"users", "content", "courses", "sessions", "submissions", "deadlines", "review", "progress"}
-	instance.Services = make(map[string]*Service)
-	for _, serviceName := range masterServices {
+	config := instance.config()
+	globalConfig := instance.globalConfig()
+	os.MkdirAll(path.Join(globalConfig.LogFileDir, instance.Name), 0o770)
+	os.MkdirAll(path.Join(globalConfig.PidFileDir, instance.Name), 0o770)
+	definitions := serviceDefinitions(globalConfig, config)
+	services := make(map[string]*Service)
+	for serviceName, definition := range definitions {
 		var initialStatus ServiceStatus
-		if slices.Contains(instance.Config.AutostartServices, serviceName) {
+		if slices.Contains(config.AutostartServices, serviceName) {
 			initialStatus = ServiceStatus_STOPPED
 		} else {
 			initialStatus = ServiceStatus_DISABLED
 		}
-		service := NewService(
-			instance.Config.InstanceName,
-			serviceName,
-			instance.GlobalConfig.ServiceExecutables[serviceName],
-			path.Join(instance.GlobalConfig.LogFileDir, instance.Config.InstanceName, serviceName+".log"),
-			path.Join(instance.GlobalConfig.PidFileDir, instance.Config.InstanceName, serviceName+".pid"),
-			path.Join(instance.GlobalConfig.SockFileDir, instance.Config.InstanceName, serviceName+".sock"),
-			initialStatus,
-			instance.GlobalConfig.RestartPolicy,
-			instance.GlobalConfig.ShutdownTimeout,
-			instance.exitHandler,
-		)
+		services[serviceName] = instance.newService(serviceName, definition, initialStatus)
+	}
+	// grader is always present but might be disabled by configuration
+	var graderInitialStatus ServiceStatus
+	if config.AutostartGrader {
+		graderInitialStatus = ServiceStatus_STOPPED
+	} else {
+		graderInitialStatus = ServiceStatus_DISABLED
+	}
+	for replica := 1; replica <= config.GraderReplicas; replica++ {
+		grader := instance.newGraderReplica(replica, graderInitialStatus)
+		services[grader.ServiceName] = grader
+	}
+	instance.mutex.Lock()
+	instance.Services = services
+	instance.Grader = services[graderServiceName]
+	instance.mutex.Unlock()
+}
+
+func (instance *Instance) newService(serviceName string, definition ServiceConf, initialStatus ServiceStatus) *Service {
+	config := instance.config()
+	globalConfig := instance.globalConfig()
+	service := NewService(
+		instance.Name,
+		serviceName,
+		definition.Executable,
+		path.Join(globalConfig.LogFileDir, instance.Name, serviceName+".log"),
+		path.Join(globalConfig.PidFileDir, instance.Name, serviceName+".pid"),
+		instance.sockFileName(serviceName, definition),
+		initialStatus,
+		serviceRestartPolicy(globalConfig, config, serviceName),
+		globalConfig.HealthCheck,
+		globalConfig.LogRotation,
+		globalConfig.ShutdownTimeout,
+		instance.exitHandler,
+	)
+	instance.configureService(service)
+	return service
+}
+
+func (instance *Instance) sockFileName(serviceName string, definition ServiceConf) string {
+	if !definition.Socket {
+		return ""
+	}
+	return path.Join(instance.globalConfig().SockFileDir, instance.Name, serviceName+".sock")
+}
+
+// updateServices creates services added to instance configuration
+// and stops and removes ones which definitions were removed
+func (instance *Instance) updateServices() (changes []string) {
+	config := instance.config()
+	definitions := serviceDefinitions(instance.globalConfig(), config)
+	services := instance.services()
+	added := make(map[string]*Service)
+	for serviceName, definition := range definitions {
+		if _, exists := services[serviceName]; !exists {
+			added[serviceName] = instance.newService(serviceName, definition, ServiceStatus_DISABLED)
+			changes = append(changes, "added service "+serviceName)
+		}
+	}
+	removed := make([]string, 0)
+	for serviceName := range services {
+		if _, defined := definitions[serviceName]; !defined && !isGraderService(serviceName) {
+			removed = append(removed, serviceName)
+			changes = append(changes, "removed service "+serviceName)
+		}
+	}
+	if len(removed) > 0 {
+		instance.Stop(removed)
+	}
+	instance.mutex.Lock()
+	for serviceName, service := range added {
 		instance.Services[serviceName] = service
 	}
-	if instance.Config.AutostartGrader {
-		instance.Services["grader"] = instance.Grader
+	for _, serviceName := range removed {
+		delete(instance.Services, serviceName)
+	}
+	instance.mutex.Unlock()
+	sort.Strings(changes)
+	return changes
+}
+
+// configureService applies settings which depend on both server and instance configuration
+func (instance *Instance) configureService(service *Service) {
+	globalConfig := instance.globalConfig()
+	service.SetStatusListener(instance.statusHandler)
+	if isGraderService(service.ServiceName) {
+		service.SetDrainTimeout(globalConfig.DrainTimeout)
+		service.SetDefinition(graderDefinition(globalConfig, instance.config()), "")
+	} else if definition, defined := serviceDefinitions(globalConfig, instance.config())[service.ServiceName]; defined {
+		service.SetDefinition(definition, instance.sockFileName(service.ServiceName, definition))
+	}
+	service.SetCgroup(globalConfig.CgroupRoot,
+		serviceCgroupPath(globalConfig.CgroupRoot, instance.Name, service.ServiceName))
+	service.SetResourceLimits(serviceResourceLimits(globalConfig, instance.config(), baseServiceName(service.ServiceName)))
+	service.SetEventHistory(globalConfig.EventHistory)
+	service.SetSocketActivation(globalConfig.SocketActivation)
+	service.SetProcessAdoption(globalConfig.ProcessAdoption.Enabled)
+}
+
+func (instance *Instance) config() *SupervisorConfig {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.Config
+}
+
+func (instance *Instance) globalConfig() *ServerConfig {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.GlobalConfig
+}
+
+// service returns instance service by name or nil if not exists
+func (instance *Instance) service(serviceName string) *Service {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.Services[serviceName]
+}
+
+// services returns copy of services map which might be changed
+// concurrently by scaling
+func (instance *Instance) services() map[string]*Service {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	result := make(map[string]*Service, len(instance.Services))
+	for serviceName, service := range instance.Services {
+		result[serviceName] = service
+	}
+	return result
+}
+
+// expandServiceNames replaces "grader" by names of all grader replicas
+// and drops unknown and duplicate names
+func (instance *Instance) expandServiceNames(names []string) []string {
+	services := instance.services()
+	result := make([]string, 0, len(names))
+	add := func(serviceName string) {
+		if !slices.Contains(result, serviceName) {
+			result = append(result, serviceName)
+		}
+	}
+	for _, serviceName := range names {
+		if serviceName == graderServiceName {
+			for _, grader := range instance.graderReplicas() {
+				add(grader.ServiceName)
+			}
+		} else if _, exists := services[serviceName]; exists {
+			add(serviceName)
+		}
+	}
+	return result
+}
+
+// ApplyConfig replaces instance configuration without restarting running services.
+// Services disabled by new configuration are stopped while enabled ones
+// are returned to be started by caller.
+func (instance *Instance) ApplyConfig(globalConfig *ServerConfig, config *SupervisorConfig) (changes []string, enabled []string) {
+	oldConfig := instance.config()
+	instance.mutex.Lock()
+	instance.GlobalConfig = globalConfig
+	instance.Config = config
+	instance.mutex.Unlock()
+	changes = instance.updateServices()
+	wasEnabled := enabledServiceNames(oldConfig)
+	isEnabled := enabledServiceNames(config)
+	services := instance.services()
+	disabled := make([]string, 0, len(services))
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		service := services[serviceName]
+		baseName := baseServiceName(serviceName)
+		service.UpdatePolicies(serviceRestartPolicy(globalConfig, config, baseName), globalConfig.HealthCheck,
+			globalConfig.LogRotation, globalConfig.ShutdownTimeout)
+		instance.configureService(service)
+		if !wasEnabled[baseName] && isEnabled[baseName] {
+			service.SetEnabled(true)
+			enabled = append(enabled, serviceName)
+			changes = append(changes, "enabled service "+serviceName)
+		} else if wasEnabled[baseName] && !isEnabled[baseName] {
+			disabled = append(disabled, serviceName)
+			changes = append(changes, "disabled service "+serviceName)
+		}
+	}
+	if !reflect.DeepEqual(oldConfig.Dependencies, config.Dependencies) {
+		changes = append(changes, fmt.Sprintf("dependencies changed to %v", config.Dependencies))
+	}
+	if !reflect.DeepEqual(oldConfig.RestartPolicies, config.RestartPolicies) {
+		changes = append(changes, "restart policies changed")
 	}
+	if !reflect.DeepEqual(oldConfig.Services, config.Services) {
+		changes = append(changes, "service definitions changed")
+	}
+	if !reflect.DeepEqual(oldConfig.ResourceLimits, config.ResourceLimits) {
+		changes = append(changes, fmt.Sprintf("resource limits changed to %+v", config.ResourceLimits))
+	}
+	if !reflect.DeepEqual(oldConfig.Schedules, config.Schedules) {
+		changes = append(changes, "schedules changed")
+	}
+	if len(disabled) > 0 {
+		instance.Stop(disabled)
+		for _, serviceName := range disabled {
+			services[serviceName].SetEnabled(false)
+		}
+	}
+	if oldConfig.GraderReplicas != config.GraderReplicas {
+		changes = append(changes, fmt.Sprintf("grader replicas: %d -> %d", oldConfig.GraderReplicas, config.GraderReplicas))
+		if err := instance.Scale(config.GraderReplicas); err != nil {
+			instance.logger().Errorf("cant scale instance %s graders: %v", instance.Name, err)
+		}
+	}
+	return changes, enabled
+}
+
+func enabledServiceNames(config *SupervisorConfig) map[string]bool {
+	result := make(map[string]bool)
+	for _, serviceName := range config.AutostartServices {
+		result[serviceName] = true
+	}
+	if config.AutostartGrader {
+		result[graderServiceName] = true
+	}
+	return result
 }
 
 func (instance *Instance) GetServiceStatuses() []*ServiceStatusResponse {
-	result := make([]*ServiceStatusResponse, 0, len(instance.Services)+1)
-	for _, service := range instance.Services {
-		if service.ServiceName == "grader" {
+	services := instance.services()
+	result := make([]*ServiceStatusResponse, 0, len(services))
+	for _, service := range services {
+		if isGraderService(service.ServiceName) {
 			continue
 		}
 		status := service.GetStatus()
@@ -89,97 +294,187 @@ func (instance *Instance) GetServiceStatuses() []*ServiceStatusResponse {
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].ServiceName < result[j].ServiceName
 	})
-	graderStatus := instance.Grader.GetStatus()
-	result = append(result, graderStatus)
+	for _, grader := range instance.graderReplicas() {
+		result = append(result, grader.GetStatus())
+	}
 	return result
 }
 
 func (instance *Instance) Stop(names []string) {
-	servicesToStop := make([]string, 0, len(instance.Services)+1)
-	if len(names) > 0 {
-		// stop specific services
-		for _, serviceName := range names {
-			if _, ok := instance.Services[serviceName]; ok && serviceName != "grader" {
-				servicesToStop = append(servicesToStop, serviceName)
-			}
+	services := instance.services()
+	if len(names) == 0 {
+		// stop all running services
+		names = make([]string, 0, len(services))
+		for serviceName := range services {
+			names = append(names, serviceName)
 		}
-		// grader must be stopped first
-		if slices.Contains(names, "grader") {
-			servicesToStop = slices.Insert(servicesToStop, 0, "grader")
+	}
+	names = instance.expandServiceNames(names)
+	servicesToStop := make([]string, 0, len(names))
+	// graders must be stopped first
+	for _, serviceName := range names {
+		if isGraderService(serviceName) {
+			servicesToStop = append(servicesToStop, serviceName)
 		}
-	} else {
-		// stop all running services
-		servicesToStop = append(servicesToStop, "grader")
-		for _, service := range instance.Services {
-			if service.ServiceName != "grader" {
-				servicesToStop = append(servicesToStop, service.ServiceName)
-			}
+	}
+	for _, serviceName := range names {
+		if !isGraderService(serviceName) {
+			servicesToStop = append(servicesToStop, serviceName)
+		}
+	}
+	instance.logger().Infof("stopping instance %s services %v", instance.Name, servicesToStop)
+	graders := make([]*Service, 0, len(servicesToStop))
+	for _, serviceName := range servicesToStop {
+		if service := services[serviceName]; service != nil && isGraderService(serviceName) {
+			graders = append(graders, service)
 		}
 	}
-	log.Infof("stopping instance %s services %v", instance.Config.InstanceName, servicesToStop)
+	stopGraders(graders)
 	for _, serviceName := range servicesToStop {
-		service := instance.Services[serviceName]
-		if service != nil {
+		service := services[serviceName]
+		if service != nil && !isGraderService(serviceName) {
 			service.Stop()
 		}
 	}
 }
 
 func (instance *Instance) Start(names []string) {
-	instanceLogDir := path.Join(instance.GlobalConfig.LogFileDir, instance.Config.InstanceName)
-	instancePidDir := path.Join(instance.GlobalConfig.PidFileName, instance.Config.InstanceName)
-	sockDir := path.Dir(instance.GlobalConfig.GRPCSocketFileName)
-	instanceSockDir := path.Join(sockDir, instance.Config.InstanceName)
+	config := instance.config()
+	globalConfig := instance.globalConfig()
+	instanceLogDir := path.Join(globalConfig.LogFileDir, instance.Name)
+	instancePidDir := path.Join(globalConfig.PidFileName, instance.Name)
+	sockDir := path.Dir(globalConfig.GRPCSocketFileName)
+	instanceSockDir := path.Join(sockDir, instance.Name)
 	os.MkdirAll(instanceSockDir, 0o775)
 	os.MkdirAll(instancePidDir, 0o775)
 	os.MkdirAll(instanceLogDir, 0o775)
 	os.Chmod(instanceSockDir, 0o775)
 	os.Chmod(instanceLogDir, 0o775)
 	os.Chmod(instancePidDir, 0o775)
-	servicesToStart := make([]string, 0, len(instance.Services)+1)
+	servicesToStart := make([]string, 0, len(names)+config.GraderReplicas)
 	if len(names) > 0 {
-		// start specific services
+		// start specific services, graders must be started last
+		names = instance.expandServiceNames(names)
 		for _, serviceName := range names {
-			if _, ok := instance.Services[serviceName]; ok && serviceName != "grader" {
+			if !isGraderService(serviceName) {
 				servicesToStart = append(servicesToStart, serviceName)
 			}
 		}
-		// grader must be started last
-		if slices.Contains(names, "grader") {
-			servicesToStart = append(servicesToStart, "grader")
+		for _, serviceName := range names {
+			if isGraderService(serviceName) {
+				servicesToStart = append(servicesToStart, serviceName)
+			}
 		}
 	} else {
 		// start all config-enabled services
-		for _, serviceName := range instance.Config.AutostartServices {
+		for _, serviceName := range config.AutostartServices {
 			servicesToStart = append(servicesToStart, serviceName)
 		}
-		if instance.Config.AutostartGrader {
-			servicesToStart = append(servicesToStart, "grader")
+		if config.AutostartGrader {
+			servicesToStart = append(servicesToStart, instance.expandServiceNames([]string{graderServiceName})...)
 		}
 	}
-	for index, serviceName := range servicesToStart {
-		service := instance.Services[serviceName]
-		if service.GetStatus().Status != ServiceStatus_RUNNING {
-			if index > 0 {
-				var timeoutMs int
-				if serviceName == "grader" {
-					timeoutMs = instance.GlobalConfig.ChainStartIntervals.Grader
-				} else if serviceName == "webserver" || serviceName == "web" || serviceName == "grpcwebserver" {
-					timeoutMs = instance.GlobalConfig.ChainStartIntervals.GrpcWebServer
-				} else {
-					timeoutMs = instance.GlobalConfig.ChainStartIntervals.Microservice
-				}
-				time.Sleep(time.Duration(timeoutMs) * time.Millisecond)
+	startOrder, err := instance.resolveStartOrder(servicesToStart)
+	if err != nil {
+		instance.logger().Errorf("cant start instance %s services: %v", instance.Name, err)
+		for _, serviceName := range servicesToStart {
+			if service := instance.service(serviceName); service != nil && !service.SetFailed(err.Error()) {
+				instance.logger().WithField("service", serviceName).Infof("service %s@%s keeps running", serviceName, instance.Name)
 			}
+		}
+		return
+	}
+	startTimeout := time.Duration(globalConfig.StartTimeout) * time.Second
+	readiness := make(map[string]error)
+	for _, serviceName := range startOrder {
+		service := instance.service(serviceName)
+		if err := instance.waitDependencies(serviceName, startTimeout, readiness); err != nil {
+			instance.logger().WithField("service", serviceName).Warningf("cant start service %s@%s: %v", serviceName, instance.Name, err)
+			if service.SetFailed(err.Error()) {
+				readiness[serviceName] = err
+				continue
+			}
+			// already running service is not touched but its own readiness still matters
+		}
+		if service.GetStatus().Status != ServiceStatus_RUNNING {
 			service.Start()
 		}
+		readiness[serviceName] = service.WaitReady(startTimeout)
+		if err := readiness[serviceName]; err != nil {
+			instance.logger().WithField("service", serviceName).Warningf("service %s@%s is not ready: %v", serviceName, instance.Name, err)
+		}
 	}
 }
 
-func (instance *Instance) NotifyOnServiceExit(serviceName string) {
-	for _, service := range instance.Services {
-		if service != nil && service.InstanceName != serviceName {
-			service.SendSIGHUP()
+func (instance *Instance) dependenciesOf(serviceName string) []string {
+	if isGraderService(serviceName) {
+		// grader requires all enabled master services
+		return instance.config().AutostartServices
+	}
+	return instance.config().Dependencies[serviceName]
+}
+
+// resolveStartOrder sorts services so that each one follows its dependencies.
+// Enabled but not running dependencies are added to start list.
+func (instance *Instance) resolveStartOrder(names []string) ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	result := make([]string, 0, len(names))
+	state := make(map[string]int)
+	var visit func(serviceName string, requested bool) error
+	visit = func(serviceName string, requested bool) error {
+		if state[serviceName] == visiting {
+			return fmt.Errorf("dependency cycle detected at service %s", serviceName)
+		}
+		if state[serviceName] == visited {
+			return nil
+		}
+		service := instance.service(serviceName)
+		if service == nil {
+			state[serviceName] = visited
+			return nil
+		}
+		if !requested {
+			status := service.GetStatus().Status
+			if status == ServiceStatus_DISABLED || status == ServiceStatus_RUNNING {
+				state[serviceName] = visited
+				return nil
+			}
+		}
+		state[serviceName] = visiting
+		for _, dependency := range instance.dependenciesOf(serviceName) {
+			if err := visit(dependency, false); err != nil {
+				return err
+			}
+		}
+		state[serviceName] = visited
+		result = append(result, serviceName)
+		return nil
+	}
+	for _, serviceName := range names {
+		if err := visit(serviceName, true); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (instance *Instance) waitDependencies(serviceName string, timeout time.Duration, readiness map[string]error) error {
+	for _, dependency := range instance.dependenciesOf(serviceName) {
+		dependencyService := instance.service(dependency)
+		if dependencyService == nil || dependencyService.GetStatus().Status == ServiceStatus_DISABLED {
+			continue
+		}
+		err, checked := readiness[dependency]
+		if !checked {
+			err = dependencyService.WaitReady(timeout)
+			readiness[dependency] = err
+		}
+		if err != nil {
+			return fmt.Errorf("dependency %s is not ready: %v", dependency, err)
 		}
 	}
+	return nil
 }
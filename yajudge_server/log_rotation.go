@@ -0,0 +1,218 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedLogTimeFormat = "20060102-150405"
+
+// RotatingFile is append-only log file writer that moves current file
+// aside into gzip-compressed archive when it becomes too large or too old.
+// Archives are named as <file>-<timestamp>.gz, with _<sequence> added to
+// timestamp if file was rotated more than once in a second, and only the
+// most recent RetainCount of them are kept.
+type RotatingFile struct {
+	FileName string
+	Config   LogRotationConf
+
+	mutex     sync.Mutex
+	file      *os.File
+	size      int64
+	openedAt  time.Time
+	archiving sync.WaitGroup
+}
+
+func OpenRotatingFile(fileName string, config LogRotationConf) (*RotatingFile, error) {
+	result := &RotatingFile{
+		FileName: fileName,
+		Config:   config,
+	}
+	if err := result.open(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.FileName), 0o775); err != nil {
+		return fmt.Errorf("cant create directory for log file %s: %v", rf.FileName, err)
+	}
+	file, err := os.OpenFile(rf.FileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o660)
+	if err != nil {
+		return fmt.Errorf("cant create or open log file %s: %v", rf.FileName, err)
+	}
+	os.Chmod(rf.FileName, 0o660)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cant stat log file %s: %v", rf.FileName, err)
+	}
+	rf.file = file
+	rf.size = stat.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Write(data []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.mustRotate(int64(len(data))) {
+		if err := rf.rotate(); err != nil {
+			// keep writing into current file rather than lose messages
+			fmt.Fprintf(os.Stderr, "cant rotate log file %s: %v\n", rf.FileName, err)
+		}
+	}
+	n, err := rf.file.Write(data)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) SetConfig(config LogRotationConf) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.Config = config
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.archiving.Wait()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) mustRotate(incomingSize int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	maxSize := int64(rf.Config.MaxSizeMb) * 1024 * 1024
+	if maxSize > 0 && rf.size+incomingSize > maxSize {
+		return true
+	}
+	maxAge := time.Duration(rf.Config.MaxAgeHours) * time.Hour
+	return maxAge > 0 && time.Since(rf.openedAt) > maxAge
+}
+
+func (rf *RotatingFile) rotate() error {
+	archiveName := rf.archiveName(time.Now())
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	renameErr := os.Rename(rf.FileName, archiveName)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	retainCount := rf.Config.RetainCount
+	rf.archiving.Add(1)
+	go func() {
+		defer rf.archiving.Done()
+		if err := compressFile(archiveName); err != nil {
+			log.Warningf("cant compress rotated log file %s: %v", archiveName, err)
+		}
+		removeExpiredArchives(rf.FileName, retainCount)
+	}()
+	return nil
+}
+
+// archiveName returns name not taken by previous archive either
+// compressed or still being compressed
+func (rf *RotatingFile) archiveName(now time.Time) string {
+	base := rf.FileName + "-" + now.Format(rotatedLogTimeFormat)
+	result := base
+	for sequence := 1; archiveExists(result); sequence++ {
+		result = fmt.Sprintf("%s_%d", base, sequence)
+	}
+	return result
+}
+
+func archiveExists(archiveName string) bool {
+	for _, fileName := range []string{archiveName, archiveName + ".gz"} {
+		if _, err := os.Lstat(fileName); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveOrder splits archive name into timestamp and sequence number
+func archiveOrder(archiveName string) (string, int) {
+	name := strings.TrimSuffix(archiveName, ".gz")
+	if pos := strings.LastIndexByte(name, '_'); pos != -1 {
+		if sequence, err := strconv.Atoi(name[pos+1:]); err == nil {
+			return name[:pos], sequence
+		}
+	}
+	return name, 0
+}
+
+func removeExpiredArchives(fileName string, retainCount int) {
+	if retainCount <= 0 {
+		return
+	}
+	archives, _ := filepath.Glob(fileName + "-*.gz")
+	if len(archives) <= retainCount {
+		return
+	}
+	// timestamp suffix makes lexicographic order chronological
+	sort.Slice(archives, func(i, j int) bool {
+		iStamp, iSequence := archiveOrder(archives[i])
+		jStamp, jSequence := archiveOrder(archives[j])
+		if iStamp != jStamp {
+			return iStamp < jStamp
+		}
+		return iSequence < jSequence
+	})
+	for _, archive := range archives[:len(archives)-retainCount] {
+		os.Remove(archive)
+	}
+}
+
+func compressFile(fileName string) error {
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	targetName := fileName + ".gz"
+	target, err := os.OpenFile(targetName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o660)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		writer.Close()
+		target.Close()
+		os.Remove(targetName)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		target.Close()
+		os.Remove(targetName)
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	return os.Remove(fileName)
+}
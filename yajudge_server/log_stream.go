@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	logSubscriberBufferSize = 1000
+	logTailChunkSize        = 64 * 1024
+)
+
+// Log levels of both Dart services (package:logging) and Go services (logrus)
+// mapped to common severity scale
+var logLevelSeverities = map[string]int{
+	"finest":  0,
+	"finer":   0,
+	"fine":    0,
+	"trace":   0,
+	"debug":   0,
+	"config":  1,
+	"info":    1,
+	"warning": 2,
+	"warn":    2,
+	"severe":  3,
+	"shout":   3,
+	"error":   3,
+	"fatal":   3,
+	"panic":   3,
+}
+
+type outputSubscriber chan string
+
+func (service *Service) subscribeOutput() outputSubscriber {
+	subscriber := make(outputSubscriber, logSubscriberBufferSize)
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.outputSubscribers == nil {
+		service.outputSubscribers = make(map[outputSubscriber]bool)
+	}
+	service.outputSubscribers[subscriber] = true
+	return subscriber
+}
+
+func (service *Service) unsubscribeOutput(subscriber outputSubscriber) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	delete(service.outputSubscribers, subscriber)
+}
+
+func (service *Service) publishOutput(line string) {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	for subscriber := range service.outputSubscribers {
+		select {
+		case subscriber <- line:
+		default:
+			// slow reader must not block service output capture
+		}
+	}
+}
+
+func parseLogLevel(level string) (int, error) {
+	if level == "" {
+		return 0, nil
+	}
+	severity, known := logLevelSeverities[strings.ToLower(level)]
+	if !known {
+		return 0, fmt.Errorf("unknown log level %s", level)
+	}
+	return severity, nil
+}
+
+// lineSeverity detects level of line formatted either by Dart logging
+// ("<time>: INFO - message") or logrus as text ("level=info msg=...")
+// or JSON ({"level":"info","msg":...}).
+// Returns -1 for lines without level, for example stack trace continuations.
+func lineSeverity(line string) int {
+	if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "{") {
+		record := struct {
+			Level string `json:"level"`
+		}{}
+		if json.Unmarshal([]byte(trimmed), &record) == nil {
+			if severity, known := logLevelSeverities[strings.ToLower(record.Level)]; known {
+				return severity
+			}
+			return -1
+		}
+	}
+	if index := strings.Index(line, "level="); index != -1 {
+		level := line[index+len("level="):]
+		if end := strings.IndexAny(level, " \t\n"); end != -1 {
+			level = level[:end]
+		}
+		if severity, known := logLevelSeverities[strings.Trim(level, "\"")]; known {
+			return severity
+		}
+	}
+	if index := strings.Index(line, ": "); index != -1 {
+		level := line[index+2:]
+		if end := strings.Index(level, " - "); end != -1 {
+			if severity, known := logLevelSeverities[strings.ToLower(level[:end])]; known {
+				return severity
+			}
+		}
+	}
+	return -1
+}
+
+// logLevelFilter passes lines of at least minimal severity together with
+// continuation lines following them
+type logLevelFilter struct {
+	minSeverity  int
+	lastAccepted bool
+}
+
+func (filter *logLevelFilter) accept(line string) bool {
+	if filter.minSeverity == 0 {
+		return true
+	}
+	severity := lineSeverity(line)
+	if severity != -1 {
+		filter.lastAccepted = severity >= filter.minSeverity
+	}
+	return filter.lastAccepted
+}
+
+// tailFile returns at most count last lines of file
+func tailFile(fileName string, count int) ([]string, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := stat.Size()
+	var data []byte
+	for offset > 0 && bytes.Count(data, []byte{'\n'}) <= count {
+		chunkSize := int64(logTailChunkSize)
+		if chunkSize > offset {
+			chunkSize = offset
+		}
+		offset -= chunkSize
+		chunk := make([]byte, chunkSize)
+		if _, err := file.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(chunk, data...)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if offset > 0 {
+		// first line might be partial
+		lines = lines[1:]
+	}
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return lines, nil
+}
+
+func (service *SupervisorService) StreamLogs(request *LogsRequest, stream Supervisor_StreamLogsServer) error {
+	services, err := service.findServices(request.InstanceName, request.ServiceNames)
+	if err != nil {
+		return err
+	}
+	minSeverity, err := parseLogLevel(request.Level)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	type taggedLine struct {
+		serviceName string
+		line        string
+	}
+	lines := make(chan taggedLine, logSubscriberBufferSize)
+	done := stream.Context().Done()
+	if request.Follow {
+		// subscribe before reading backlog to not miss lines written meanwhile
+		for _, target := range services {
+			subscriber := target.subscribeOutput()
+			defer target.unsubscribeOutput(subscriber)
+			go func(serviceName string, subscriber outputSubscriber) {
+				for {
+					select {
+					case line := <-subscriber:
+						select {
+						case lines <- taggedLine{serviceName, strings.TrimSuffix(line, "\n")}:
+						case <-done:
+							return
+						}
+					case <-done:
+						return
+					}
+				}
+			}(target.ServiceName, subscriber)
+		}
+	}
+	filters := make(map[string]*logLevelFilter)
+	for _, target := range services {
+		filters[target.ServiceName] = &logLevelFilter{minSeverity: minSeverity}
+		backlog, err := tailFile(target.LogFile, int(request.Backlog))
+		if err != nil && !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "cant read log file %s: %v", target.LogFile, err)
+		}
+		for _, line := range backlog {
+			if !filters[target.ServiceName].accept(line) {
+				continue
+			}
+			if err := stream.Send(&LogLine{ServiceName: target.ServiceName, Line: line}); err != nil {
+				return err
+			}
+		}
+	}
+	if !request.Follow {
+		return nil
+	}
+	for {
+		select {
+		case tagged := <-lines:
+			if !filters[tagged.serviceName].accept(tagged.line) {
+				continue
+			}
+			if err := stream.Send(&LogLine{ServiceName: tagged.serviceName, Line: tagged.line}); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
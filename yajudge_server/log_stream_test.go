@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestLineSeverity(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected int
+	}{
+		{"2023-03-01 10:00:00.000: INFO - service started", 1},
+		{"2023-03-01 10:00:00.000: SEVERE - cant connect to database", 3},
+		{`time="2023-03-01T10:00:00Z" level=warning msg="slow request"`, 2},
+		{"level=debug msg=connected", 0},
+		{`{"level":"info","msg":"request finished","time":"2023-03-01T10:00:00Z"}`, 1},
+		{`{"msg":"failed", "level": "error"}`, 3},
+		{`{"level":"unknown","msg":"x"}`, -1},
+		{"    at main (file:///main.dart:10:5)", -1},
+		{"{ not json", -1},
+	}
+	for _, test := range tests {
+		if severity := lineSeverity(test.line); severity != test.expected {
+			t.Errorf("lineSeverity(%q) = %d, expected %d", test.line, severity, test.expected)
+		}
+	}
+}
+
+func TestLogLevelFilter(t *testing.T) {
+	filter := logLevelFilter{minSeverity: 2}
+	lines := []struct {
+		line     string
+		accepted bool
+	}{
+		{`{"level":"info","msg":"started"}`, false},
+		{`{"level":"error","msg":"failed"}`, true},
+		{"goroutine 1 [running]:", true},
+		{`{"level":"debug","msg":"retry"}`, false},
+		{"    continuation of debug", false},
+	}
+	for _, test := range lines {
+		if accepted := filter.accept(test.line); accepted != test.accepted {
+			t.Errorf("accept(%q) = %v, expected %v", test.line, accepted, test.accepted)
+		}
+	}
+}
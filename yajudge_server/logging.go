@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"os"
+	"strings"
+	"time"
+)
+
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	}
+	return nil, fmt.Errorf("unknown log_format '%s', expected json or text", format)
+}
+
+func logLevel(level string) (log.Level, error) {
+	if level == "" {
+		return log.InfoLevel, nil
+	}
+	return log.ParseLevel(level)
+}
+
+func (config *ServerConfig) validateLogging() error {
+	if _, err := logFormatter(config.LogFormat); err != nil {
+		return err
+	}
+	_, err := logLevel(config.LogLevel)
+	return err
+}
+
+// configureLogger sets format and level of supervisor log
+func (config *ServerConfig) configureLogger() {
+	if formatter, err := logFormatter(config.LogFormat); err == nil {
+		log.SetFormatter(formatter)
+	}
+	if level, err := logLevel(config.LogLevel); err == nil {
+		log.SetLevel(level)
+	}
+}
+
+// logger returns log entry with fields identifying service,
+// it does not lock service so might be used while mutex is held
+func (service *Service) logger() *log.Entry {
+	fields := log.Fields{"service": service.ServiceName}
+	if service.InstanceName != "" {
+		fields["instance"] = service.InstanceName
+	}
+	return log.WithFields(fields)
+}
+
+// eventLogger returns log entry for service lifecycle event of process
+func (service *Service) eventLogger(event ServiceEventType, pid int) *log.Entry {
+	entry := service.logger().WithField("event", strings.ToLower(strings.TrimPrefix(event.String(), "EVENT_")))
+	if pid != 0 {
+		entry = entry.WithField("pid", pid)
+	}
+	return entry
+}
+
+func (instance *Instance) logger() *log.Entry {
+	return log.WithField("instance", instance.Name)
+}
+
+// rpcLogger returns log entry describing finished supervisor call
+func rpcLogger(ctx context.Context, fullMethod string, started time.Time, err error) *log.Entry {
+	fields := log.Fields{
+		"grpc_method": fullMethod,
+		"grpc_code":   status.Code(err).String(),
+		"duration":    time.Since(started).Seconds(),
+	}
+	if callerPeer, peerFound := peer.FromContext(ctx); peerFound {
+		if local, isLocal := callerPeer.AuthInfo.(peerCredentials); isLocal {
+			fields["caller_uid"] = local.Uid
+			fields["caller_pid"] = local.Pid
+		} else if callerPeer.Addr != nil {
+			fields["remote_addr"] = callerPeer.Addr.String()
+		}
+	}
+	return log.WithFields(fields)
+}
+
+func logUnary(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	started := time.Now()
+	response, err := handler(ctx, request)
+	rpcLogger(ctx, info.FullMethod, started, err).Debugf("handled %s", info.FullMethod)
+	return response, err
+}
+
+func logStream(server interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	started := time.Now()
+	err := handler(server, stream)
+	rpcLogger(stream.Context(), info.FullMethod, started, err).Debugf("handled %s", info.FullMethod)
+	return err
+}
+
+func processPid(process *os.Process) int {
+	if process == nil {
+		return 0
+	}
+	return process.Pid
+}
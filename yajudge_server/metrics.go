@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MetricsConf struct {
+	// HTTP address like ":9101", metrics are not exported if empty
+	ListenAddress string `yaml:"listen_address" json:"listen_address"`
+	Path          string `yaml:"path" json:"path"`
+}
+
+type rpcCallKey struct {
+	method string
+	code   string
+}
+
+// rpcCounters counts supervisor gRPC calls by method and result code
+type rpcCounters struct {
+	mutex sync.Mutex
+	calls map[rpcCallKey]uint64
+}
+
+func (counters *rpcCounters) add(fullMethod string, err error) {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	key := rpcCallKey{method: method, code: status.Code(err).String()}
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	if counters.calls == nil {
+		counters.calls = make(map[rpcCallKey]uint64)
+	}
+	counters.calls[key]++
+}
+
+func (counters *rpcCounters) snapshot() map[rpcCallKey]uint64 {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	result := make(map[rpcCallKey]uint64, len(counters.calls))
+	for key, value := range counters.calls {
+		result[key] = value
+	}
+	return result
+}
+
+func (counters *rpcCounters) unaryInterceptor(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	response, err := handler(ctx, request)
+	counters.add(info.FullMethod, err)
+	return response, err
+}
+
+func (counters *rpcCounters) streamInterceptor(server interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(server, stream)
+	counters.add(info.FullMethod, err)
+	return err
+}
+
+// metricsWriter produces Prometheus text exposition format,
+// samples are grouped by metric name as format requires
+type metricsWriter struct {
+	names    []string
+	families map[string]*bytes.Buffer
+}
+
+func (writer *metricsWriter) write(name, metricType, help string, labels []string, value float64) {
+	if writer.families == nil {
+		writer.families = make(map[string]*bytes.Buffer)
+	}
+	family, declared := writer.families[name]
+	if !declared {
+		family = &bytes.Buffer{}
+		fmt.Fprintf(family, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+		writer.families[name] = family
+		writer.names = append(writer.names, name)
+	}
+	family.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+		}
+		family.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(family, " %v\n", value)
+}
+
+func (writer *metricsWriter) WriteTo(output io.Writer) (int64, error) {
+	var total int64
+	for _, name := range writer.names {
+		written, err := writer.families[name].WriteTo(output)
+		total += written
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (service *SupervisorService) writeServiceMetrics(writer *metricsWriter, target *Service) {
+	serviceStatus := target.GetStatus()
+	target.mutex.RLock()
+	restartAttempts := target.restartAttempts
+	lastExitCode := target.LastExitCode
+	target.mutex.RUnlock()
+	labels := []string{"instance", target.InstanceName, "service", target.ServiceName}
+	withLabel := func(name, value string) []string {
+		return append(append([]string{}, labels...), name, value)
+	}
+
+	statusNames := make([]string, 0, len(ServiceStatus_value))
+	for statusName := range ServiceStatus_value {
+		statusNames = append(statusNames, statusName)
+	}
+	sort.Strings(statusNames)
+	for _, statusName := range statusNames {
+		value := 0.0
+		if statusName == serviceStatus.Status.String() {
+			value = 1
+		}
+		writer.write("yajudge_service_status", "gauge",
+			"Current service status, 1 for actual one",
+			withLabel("status", statusName), value)
+	}
+	writer.write("yajudge_service_uptime_seconds", "gauge",
+		"Time since service process started", labels, float64(serviceStatus.Uptime))
+	writer.write("yajudge_service_crashes_since_start", "gauge",
+		"Service crashes since started by user or autostart", labels, float64(serviceStatus.CrashesSinceStart))
+	writer.write("yajudge_service_restart_attempts", "gauge",
+		"Restart attempts counted by restart policy", labels, float64(restartAttempts))
+	writer.write("yajudge_service_last_exit_code", "gauge",
+		"Exit code of last finished service process", labels, float64(lastExitCode))
+	if serviceStatus.ProbeLatencyUs > 0 {
+		writer.write("yajudge_service_probe_latency_seconds", "gauge",
+			"Latency of last gRPC health probe", labels, float64(serviceStatus.ProbeLatencyUs)/1e6)
+	}
+
+	usage := target.CumulativeResourceUsage()
+	if usage == nil {
+		return
+	}
+	writer.write("yajudge_service_memory_rss_bytes", "gauge",
+		"Resident memory of service process", labels, float64(usage.MemoryRssBytes))
+	writer.write("yajudge_service_cpu_seconds_total", "counter",
+		"CPU time consumed by service process", labels, usage.CpuTimeSec)
+	writer.write("yajudge_service_open_fds", "gauge",
+		"Open file descriptors of service process", labels, float64(usage.OpenFds))
+	writer.write("yajudge_service_threads", "gauge",
+		"Threads of service process", labels, float64(usage.Threads))
+	writer.write("yajudge_service_io_read_bytes_total", "counter",
+		"Bytes read by service from block devices", labels, float64(usage.IoReadBytes))
+	writer.write("yajudge_service_io_write_bytes_total", "counter",
+		"Bytes written by service to block devices", labels, float64(usage.IoWriteBytes))
+}
+
+func (service *SupervisorService) ServeMetrics(response http.ResponseWriter, request *http.Request) {
+	writer := &metricsWriter{}
+	instances := service.instancesList()
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	writer.write("yajudge_supervisor_instances", "gauge",
+		"Number of configured instances", nil, float64(len(instances)))
+
+	rpcCalls := service.rpcCounters.snapshot()
+	rpcKeys := make([]rpcCallKey, 0, len(rpcCalls))
+	for key := range rpcCalls {
+		rpcKeys = append(rpcKeys, key)
+	}
+	sort.Slice(rpcKeys, func(i, j int) bool {
+		if rpcKeys[i].method != rpcKeys[j].method {
+			return rpcKeys[i].method < rpcKeys[j].method
+		}
+		return rpcKeys[i].code < rpcKeys[j].code
+	})
+	for _, key := range rpcKeys {
+		writer.write("yajudge_supervisor_rpc_calls_total", "counter",
+			"Supervisor gRPC calls by method and result code",
+			[]string{"method", key.method, "code", key.code}, float64(rpcCalls[key]))
+	}
+
+	service.writeServiceMetrics(writer, service.WebServer)
+	for _, instance := range instances {
+		for _, serviceStatus := range instance.GetServiceStatuses() {
+			if instanceService := instance.service(serviceStatus.ServiceName); instanceService != nil {
+				service.writeServiceMetrics(writer, instanceService)
+			}
+		}
+	}
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.WriteTo(response)
+}
+
+func (service *SupervisorService) startMetricsServer() {
+	config := service.config().Metrics
+	if config.ListenAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, service.ServeMetrics)
+	log.Infof("serving metrics at http://%s%s", config.ListenAddress, config.Path)
+	go func() {
+		if err := http.ListenAndServe(config.ListenAddress, mux); err != nil {
+			log.Errorf("cant serve metrics at %s: %v", config.ListenAddress, err)
+		}
+	}()
+}
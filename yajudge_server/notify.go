@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	notifyMessageMaxSize = 4096
+	// supervisor status is sent to systemd at least this often
+	systemdStatusInterval = 10 * time.Second
+)
+
+// systemd notification socket of supervisor itself, it is not passed to services
+var systemdNotifySocket string
+var systemdWatchdogInterval time.Duration
+
+func (service *Service) notifySocketName() string {
+	return strings.TrimSuffix(service.PidFile, ".pid") + ".notify"
+}
+
+// openNotifySocket creates datagram socket which service process reports its
+// state to in sd_notify format, the same socket is used while service runs
+func (service *Service) openNotifySocket() (string, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	socketName := service.notifySocketName()
+	if service.notifyConn != nil {
+		return socketName, nil
+	}
+	os.Remove(socketName)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return "", fmt.Errorf("cant create notification socket %s: %v", socketName, err)
+	}
+	// sender pid is required to ignore messages of not main processes
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		rawConn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+		})
+	}
+	if err != nil {
+		conn.Close()
+		os.Remove(socketName)
+		return "", fmt.Errorf("cant enable credentials passing on %s: %v", socketName, err)
+	}
+	// service might run as another user
+	os.Chmod(socketName, 0o666)
+	service.notifyConn = conn
+	go service.receiveNotifications(conn)
+	return socketName, nil
+}
+
+func (service *Service) closeNotifySocket() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.notifyConn == nil {
+		return
+	}
+	service.notifyConn.Close()
+	service.notifyConn = nil
+	os.Remove(service.notifySocketName())
+}
+
+// notifyEnvironment returns variables telling service where to send notifications
+func (service *Service) notifyEnvironment() []string {
+	socketName, err := service.openNotifySocket()
+	if err != nil {
+		service.logger().Warningf("service %s@%s will not be able to send notifications: %v",
+			service.ServiceName, service.InstanceName, err)
+		return nil
+	}
+	result := []string{"NOTIFY_SOCKET=" + socketName}
+	service.mutex.RLock()
+	watchdogSec := service.WatchdogSec
+	service.mutex.RUnlock()
+	if watchdogSec > 0 {
+		result = append(result, "WATCHDOG_USEC="+strconv.FormatInt(int64(watchdogSec)*1000000, 10))
+	}
+	return result
+}
+
+func (service *Service) receiveNotifications(conn *net.UnixConn) {
+	message := make([]byte, notifyMessageMaxSize)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	for {
+		size, oobSize, _, _, err := conn.ReadMsgUnix(message, oob)
+		if err != nil {
+			// socket closed
+			return
+		}
+		controlMessages, err := syscall.ParseSocketControlMessage(oob[:oobSize])
+		if err != nil || len(controlMessages) == 0 {
+			continue
+		}
+		credentials, err := syscall.ParseUnixCredentials(&controlMessages[0])
+		if err != nil {
+			continue
+		}
+		service.handleNotification(int(credentials.Pid), string(message[:size]))
+	}
+}
+
+func (service *Service) handleNotification(pid int, message string) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	mainProcess := service.process != nil && service.process.Pid == pid
+	for _, line := range strings.Split(message, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch {
+		case key == "READY" && value == "1":
+			// replacing process reports readiness before it becomes main one
+			service.readyPid = pid
+		case key == "STATUS" && mainProcess:
+			if service.statusText != value {
+				service.statusText = value
+				service.publishStatus()
+			}
+		case key == "WATCHDOG" && value == "1" && mainProcess:
+			service.lastWatchdog = time.Now()
+		}
+	}
+}
+
+// resetNotifications must be called with mutex locked when new main process is set
+func (service *Service) resetNotifications() {
+	service.statusText = ""
+	service.lastWatchdog = time.Now()
+}
+
+// notifiedReady reports if main process sent READY=1, must be called with mutex locked
+func (service *Service) notifiedReady() bool {
+	return service.process != nil && service.readyPid == service.process.Pid
+}
+
+// waitNotifyReady blocks until process sends READY=1
+func (service *Service) waitNotifyReady(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if processFinished(pid) {
+			return fmt.Errorf("process exited")
+		}
+		service.mutex.RLock()
+		ready := service.readyPid == pid
+		service.mutex.RUnlock()
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("READY=1 not received within %v", timeout)
+		}
+		time.Sleep(readinessProbeInterval)
+	}
+}
+
+func (service *Service) startWatchdogMonitor() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.WatchdogSec <= 0 || service.watchdogMonitorActive {
+		return
+	}
+	service.watchdogMonitorActive = true
+	go service.monitorWatchdog()
+}
+
+// monitorWatchdog kills service which did not send WATCHDOG=1 within watchdog interval,
+// so it is restarted under restart policy
+func (service *Service) monitorWatchdog() {
+	for {
+		service.mutex.RLock()
+		watchdog := time.Duration(service.WatchdogSec) * time.Second
+		service.mutex.RUnlock()
+		if watchdog <= 0 {
+			break
+		}
+		time.Sleep(watchdog / 4)
+		service.mutex.Lock()
+		serviceStatus := service.Status
+		if serviceStatus == ServiceStatus_RESPAWNING || serviceStatus == ServiceStatus_UNHEALTHY {
+			service.mutex.Unlock()
+			continue
+		}
+		if serviceStatus != ServiceStatus_RUNNING {
+			service.mutex.Unlock()
+			break
+		}
+		silence := time.Since(service.lastWatchdog)
+		if silence < watchdog {
+			service.mutex.Unlock()
+			continue
+		}
+		reason := fmt.Sprintf("watchdog timeout, no WATCHDOG=1 within %v", watchdog)
+		service.Error = reason
+		service.setStatus(ServiceStatus_UNHEALTHY)
+		process := service.process
+		service.mutex.Unlock()
+		service.eventLogger(ServiceEventType_EVENT_KILLED_UNHEALTHY, processPid(process)).Warningf("service %s@%s %s, killing it to restart", service.ServiceName, service.InstanceName, reason)
+		service.recordEvent(&ServiceEvent{
+			Type:    ServiceEventType_EVENT_KILLED_UNHEALTHY,
+			Message: reason,
+		})
+		if process != nil {
+			// process exit will be handled by monitorProcess under restart policy
+			process.Signal(syscall.SIGKILL)
+		}
+	}
+	service.mutex.Lock()
+	service.watchdogMonitorActive = false
+	service.mutex.Unlock()
+}
+
+// takeSystemdNotifySocket remembers systemd notification settings of supervisor
+// and removes them from environment to not be inherited by services
+func takeSystemdNotifySocket() {
+	systemdNotifySocket = os.Getenv("NOTIFY_SOCKET")
+	watchdogPid := os.Getenv("WATCHDOG_PID")
+	if watchdogUsec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil {
+		if watchdogPid == "" || watchdogPid == strconv.Itoa(os.Getpid()) {
+			systemdWatchdogInterval = time.Duration(watchdogUsec) * time.Microsecond
+		}
+	}
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(name)
+	}
+}
+
+// sdNotify sends state to systemd if supervisor is started by Type=notify unit
+func sdNotify(state string) {
+	if systemdNotifySocket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: systemdNotifySocket, Net: "unixgram"})
+	if err != nil {
+		log.Warningf("cant notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warningf("cant notify systemd: %v", err)
+	}
+}
+
+// statusSummary describes supervisor state for systemd
+func (service *SupervisorService) statusSummary() string {
+	instances := service.instancesList()
+	running, total := 0, 0
+	for _, instance := range instances {
+		for _, serviceStatus := range instance.GetServiceStatuses() {
+			if serviceStatus.Status == ServiceStatus_DISABLED {
+				continue
+			}
+			total++
+			if serviceStatus.Status == ServiceStatus_RUNNING {
+				running++
+			}
+		}
+	}
+	summary := fmt.Sprintf("%d of %d services running in %d instances", running, total, len(instances))
+	if !service.autostartDone.Load() {
+		summary = "starting services, " + summary
+	}
+	return summary
+}
+
+// notifySystemd reports supervisor readiness and then keeps status
+// up to date and pings systemd watchdog if it is enabled
+func (service *SupervisorService) notifySystemd() {
+	if systemdNotifySocket == "" {
+		return
+	}
+	sdNotify("READY=1\nSTATUS=" + service.statusSummary())
+	interval := systemdStatusInterval
+	if systemdWatchdogInterval > 0 && systemdWatchdogInterval/2 < interval {
+		interval = systemdWatchdogInterval / 2
+	}
+	for {
+		time.Sleep(interval)
+		state := "STATUS=" + service.statusSummary()
+		if systemdWatchdogInterval > 0 {
+			state += "\nWATCHDOG=1"
+		}
+		sdNotify(state)
+	}
+}
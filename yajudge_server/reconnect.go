@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"golang.org/x/exp/slices"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlMessageTimeout limits delivery of control message to service
+const controlMessageTimeout = time.Second
+
+// graderEndpoints are the only master services API used by grader
+var graderEndpoints = []string{"yajudge.SubmissionManagement"}
+
+// masterServiceClientEndpoints lists API each master service is client of
+var masterServiceClientEndpoints = map[string][]string{
+	"courses":  {"yajudge.UserManagement"},
+	"sessions": {"yajudge.CourseManagement", "yajudge.UserManagement"},
+	"deadlines": {"yajudge.CourseContentProvider", "yajudge.CourseManagement",
+		"yajudge.UserManagement"},
+	"progress": {"yajudge.CourseContentProvider", "yajudge.CourseManagement",
+		"yajudge.DeadlinesManagement"},
+	"review": {"yajudge.SubmissionManagement", "yajudge.UserManagement"},
+	"submissions": {"yajudge.CourseContentProvider", "yajudge.CourseManagement",
+		"yajudge.DeadlinesManagement", "yajudge.ProgressCalculator", "yajudge.UserManagement"},
+}
+
+// controlSocketName is where service process accepts control messages if it supports them,
+// the socket is created by process itself and removed by supervisor after process exit
+func (service *Service) controlSocketName() string {
+	return strings.TrimSuffix(service.PidFile, ".pid") + ".control"
+}
+
+// SendControlMessage writes message to control socket of service process
+func (service *Service) SendControlMessage(message string) error {
+	conn, err := net.DialTimeout("unix", service.controlSocketName(), controlMessageTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(controlMessageTimeout))
+	_, err = conn.Write([]byte(message))
+	return err
+}
+
+// notifyReconnect tells running service to reconnect to restarted endpoints.
+// Services not accepting control messages get SIGHUP if signalFallback is set.
+func (service *Service) notifyReconnect(message string, signalFallback bool) {
+	if service.GetStatus().Status != ServiceStatus_RUNNING {
+		return
+	}
+	err := service.SendControlMessage(message)
+	if err == nil {
+		service.logger().Debugf("sent reconnect message to %s@%s", service.ServiceName, service.InstanceName)
+		return
+	}
+	if signalFallback {
+		service.logger().Infof("sending SIGHUP to %s@%s to reconnect, no control socket: %v",
+			service.ServiceName, service.InstanceName, err)
+		service.SendSIGHUP()
+	}
+}
+
+// reconnectMessage names instance and its restarted endpoints, one KEY=VALUE per line.
+// Message without RECONNECT lines means that all endpoints of instance must be reconnected.
+func reconnectMessage(instanceName, serviceName string, endpoints []string) string {
+	message := fmt.Sprintf("INSTANCE=%s\nSERVICE=%s\n", instanceName, serviceName)
+	for _, endpoint := range endpoints {
+		message += fmt.Sprintf("RECONNECT=%s\n", endpoint)
+	}
+	return message
+}
+
+// usesEndpoints reports if client of used API is affected by restart of endpoints,
+// nil endpoints mean that restarted ones are unknown
+func usesEndpoints(used, endpoints []string) bool {
+	if endpoints == nil {
+		return true
+	}
+	for _, endpoint := range endpoints {
+		if slices.Contains(used, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointsFileName is the same file master services and webserver resolve API names with
+func (instance *Instance) endpointsFileName() string {
+	return path.Join(path.Dir(instance.config().FileName), "endpoints.yaml")
+}
+
+// serviceEndpoints returns names of API served on unix socket of service
+func (instance *Instance) serviceEndpoints(service *Service) ([]string, error) {
+	if service.SockFile == "" {
+		// graders and custom services without socket do not serve any API
+		return []string{}, nil
+	}
+	content, err := os.ReadFile(instance.endpointsFileName())
+	if err != nil {
+		return nil, fmt.Errorf("cant read endpoints file: %v", err)
+	}
+	links := make(map[string]string)
+	if err := yaml.Unmarshal(content, &links); err != nil {
+		return nil, fmt.Errorf("cant parse endpoints file %s: %v", instance.endpointsFileName(), err)
+	}
+	result := make([]string, 0)
+	for name, link := range links {
+		endpointUrl, err := url.Parse(link)
+		if err != nil || endpointUrl.Scheme != "unix" {
+			continue
+		}
+		if path.Clean(endpointUrl.Path) == path.Clean(service.SockFile) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// NotifyReconnect tells services of instance depending on exited one to reconnect
+// to its endpoints and returns the endpoints for webserver to reconnect to
+func (instance *Instance) NotifyReconnect(exited *Service) (message string, notifyWebServer bool) {
+	endpoints, err := instance.serviceEndpoints(exited)
+	if err != nil {
+		instance.logger().Warningf("%v, all services of instance %s will reconnect", err, instance.Name)
+		endpoints = nil
+	}
+	message = reconnectMessage(instance.Name, exited.ServiceName, endpoints)
+	// unknown endpoints are treated as all ones
+	hasEndpoints := endpoints == nil || len(endpoints) > 0
+	dependencies := instance.config().Dependencies
+	for _, service := range instance.services() {
+		if service == nil || service == exited {
+			continue
+		}
+		dependent := slices.Contains(dependencies[service.ServiceName], exited.ServiceName)
+		switch {
+		case isGraderService(service.ServiceName):
+			if usesEndpoints(graderEndpoints, endpoints) {
+				go service.notifyReconnect(message, true)
+			}
+		case isBuiltinService(service.ServiceName):
+			// master services connect to each other on demand
+			clientEndpoints := masterServiceClientEndpoints[service.ServiceName]
+			if dependent || (hasEndpoints && usesEndpoints(clientEndpoints, endpoints)) {
+				go service.notifyReconnect(message, true)
+			}
+		default:
+			// custom services might not expect SIGHUP
+			if dependent {
+				go service.notifyReconnect(message, false)
+			}
+		}
+	}
+	return message, hasEndpoints
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"sort"
+)
+
+func (service *SupervisorService) Reload(ctx context.Context, request *Empty) (*ReloadResponse, error) {
+	response, err := service.reloadConfig()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cant reload configuration: %v", err)
+	}
+	return response, nil
+}
+
+func (service *SupervisorService) config() *ServerConfig {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	return service.Config
+}
+
+// reloadConfig rescans server.yaml and instances configurations and applies
+// changes to running services without restarting them. New instances are
+// started and removed ones are stopped.
+func (service *SupervisorService) reloadConfig() (*ReloadResponse, error) {
+	service.reloadMutex.Lock()
+	defer service.reloadMutex.Unlock()
+	oldConfig := service.config()
+	newConfig, err := LoadServerConfig(oldConfig.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := newConfig.ResolvePaths(oldConfig.YajudgeRootDir); err != nil {
+		return nil, err
+	}
+	// these values are set by command line and bound to running supervisor
+	newConfig.LogFileName = oldConfig.LogFileName
+	newConfig.PidFileName = oldConfig.PidFileName
+	newConfig.GRPCSocketFileName = oldConfig.GRPCSocketFileName
+	newConfig.SockFileDir = oldConfig.SockFileDir
+
+	response := &ReloadResponse{
+		Changes: globalConfigChanges(oldConfig, newConfig),
+	}
+	newConfig.configureLogger()
+	service.mutex.Lock()
+	service.Config = newConfig
+	oldInstances := service.Instances
+	newInstances := make(map[string]*Instance, len(newConfig.Instances))
+	addedInstances := make([]*Instance, 0, len(newConfig.Instances))
+	for _, instanceConfig := range newConfig.Instances {
+		if instance, exists := oldInstances[instanceConfig.InstanceName]; exists {
+			newInstances[instanceConfig.InstanceName] = instance
+		} else {
+			instance := NewInstance(newConfig, instanceConfig, service.NotifyOnServiceExit, service.publishStatus)
+			newInstances[instanceConfig.InstanceName] = instance
+			addedInstances = append(addedInstances, instance)
+			response.AddedInstances = append(response.AddedInstances, instance.Name)
+		}
+	}
+	removedInstances := make([]*Instance, 0)
+	for instanceName, instance := range oldInstances {
+		if _, exists := newInstances[instanceName]; !exists {
+			removedInstances = append(removedInstances, instance)
+			response.RemovedInstances = append(response.RemovedInstances, instanceName)
+		}
+	}
+	service.Instances = newInstances
+	service.mutex.Unlock()
+	sort.Strings(response.AddedInstances)
+	sort.Strings(response.RemovedInstances)
+
+	for _, instance := range removedInstances {
+		instance.logger().Infof("instance %s removed from configuration, stopping it", instance.Name)
+		instance.Stop([]string{})
+	}
+	for _, instanceConfig := range newConfig.Instances {
+		instance, existed := oldInstances[instanceConfig.InstanceName]
+		if !existed {
+			continue
+		}
+		changes, enabled := instance.ApplyConfig(newConfig, instanceConfig)
+		for _, change := range changes {
+			response.Changes = append(response.Changes, fmt.Sprintf("instance %s: %s", instance.Name, change))
+		}
+		if len(enabled) > 0 && instance.MaintenanceUntil().IsZero() {
+			go instance.Start(enabled)
+		}
+	}
+	for _, instance := range addedInstances {
+		instance.logger().Infof("new instance %s found in configuration, starting it", instance.Name)
+		go instance.Start([]string{})
+	}
+
+	service.WebServer.UpdatePolicies(newConfig.RestartPolicy, newConfig.HealthCheck,
+		newConfig.LogRotation, newConfig.ShutdownTimeout)
+	service.configureWebServer(newConfig)
+	if newConfig.AutostartGrpcWebServer && !oldConfig.AutostartGrpcWebServer {
+		service.WebServer.SetEnabled(true)
+		go service.WebServer.Start()
+	} else if !newConfig.AutostartGrpcWebServer && oldConfig.AutostartGrpcWebServer {
+		service.WebServer.Stop()
+		service.WebServer.SetEnabled(false)
+	}
+	for _, change := range response.Changes {
+		log.Infof("configuration reloaded: %s", change)
+	}
+	return response, nil
+}
+
+func globalConfigChanges(oldConfig, newConfig *ServerConfig) []string {
+	changes := make([]string, 0)
+	addChange := func(name string, oldValue, newValue interface{}) {
+		if oldValue != newValue {
+			changes = append(changes, fmt.Sprintf("%s: %+v -> %+v", name, oldValue, newValue))
+		}
+	}
+	addChange("autostart_grpcwebserver", oldConfig.AutostartGrpcWebServer, newConfig.AutostartGrpcWebServer)
+	addChange("log_format", oldConfig.LogFormat, newConfig.LogFormat)
+	addChange("log_level", oldConfig.LogLevel, newConfig.LogLevel)
+	addChange("start_timeout_sec", oldConfig.StartTimeout, newConfig.StartTimeout)
+	addChange("shutdown_timeout_sec", oldConfig.ShutdownTimeout, newConfig.ShutdownTimeout)
+	addChange("drain_timeout_sec", oldConfig.DrainTimeout, newConfig.DrainTimeout)
+	addChange("restart_policy", oldConfig.RestartPolicy, newConfig.RestartPolicy)
+	addChange("health_check", oldConfig.HealthCheck, newConfig.HealthCheck)
+	addChange("log_rotation", oldConfig.LogRotation, newConfig.LogRotation)
+	addChange("metrics (requires supervisor restart)", oldConfig.Metrics, newConfig.Metrics)
+	addChange("remote_api (requires supervisor restart)", oldConfig.RemoteAPI, newConfig.RemoteAPI)
+	addChange("event_history", oldConfig.EventHistory, newConfig.EventHistory)
+	addChange("audit_log_file", oldConfig.AuditLogFile, newConfig.AuditLogFile)
+	addChange("cgroup_root", oldConfig.CgroupRoot, newConfig.CgroupRoot)
+	addChange("socket_activation", oldConfig.SocketActivation, newConfig.SocketActivation)
+	addChange("process_adoption", oldConfig.ProcessAdoption, newConfig.ProcessAdoption)
+	if !reflect.DeepEqual(oldConfig.ResourceLimits, newConfig.ResourceLimits) {
+		changes = append(changes, fmt.Sprintf("resource_limits: %+v -> %+v", oldConfig.ResourceLimits, newConfig.ResourceLimits))
+	}
+	if !reflect.DeepEqual(oldConfig.WebServer, newConfig.WebServer) {
+		// values are not logged as environment might contain secrets
+		changes = append(changes, "webserver (takes effect on next webserver start)")
+	}
+	if !reflect.DeepEqual(oldConfig.AccessPolicy, newConfig.AccessPolicy) {
+		changes = append(changes, fmt.Sprintf("access_policy: %+v -> %+v", oldConfig.AccessPolicy, newConfig.AccessPolicy))
+	}
+	return changes
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"os"
+)
+
+type RemoteAPIConf struct {
+	// TCP address like ":9102", supervisor is available only by unix socket if empty
+	ListenAddress string `yaml:"listen_address" json:"listen_address"`
+	CertFile      string `yaml:"cert_file" json:"cert_file"`
+	KeyFile       string `yaml:"key_file" json:"key_file"`
+	// clients must present certificate signed by this CA
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+}
+
+func (config *RemoteAPIConf) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cant load server certificate: %v", err)
+	}
+	caData, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cant read CA file: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certificateName returns common name of verified client certificate
+func certificateName(info credentials.TLSInfo) string {
+	if len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// startRemoteServer serves supervisor gRPC service on TCP address with mutual TLS,
+// clients are allowed by access policy rules matching their certificate names
+func (service *SupervisorService) startRemoteServer() {
+	config := service.config().RemoteAPI
+	if config.ListenAddress == "" {
+		return
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Errorf("remote API is not available: %v", err)
+		return
+	}
+	lis, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		log.Errorf("cant bind remote API at %s: %v", config.ListenAddress, err)
+		return
+	}
+	service.RemoteGRPCServer = grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.ChainUnaryInterceptor(logUnary, service.rpcCounters.unaryInterceptor, service.auditUnary, service.authorizeUnary),
+		grpc.ChainStreamInterceptor(logStream, service.rpcCounters.streamInterceptor, service.auditStream, service.authorizeStream),
+	)
+	RegisterSupervisorServer(service.RemoteGRPCServer, service)
+	log.Infof("serving remote API at %s", config.ListenAddress)
+	go service.RemoteGRPCServer.Serve(lis)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ is 100 on all supported Linux platforms
+const clockTicksPerSecond = 100
+
+// cpuSampleInterval is period CPU percent of services is measured over
+const cpuSampleInterval = 5 * time.Second
+
+type cpuSample struct {
+	pid     int
+	cpuTime float64
+	at      time.Time
+}
+
+type processStat struct {
+	state      byte
+	startTicks int64
+	cpuTime    float64
+	threads    int32
+	rssBytes   int64
+}
+
+// readProcessStat parses /proc/<pid>/stat, see proc(5) for fields layout
+func readProcessStat(pid int) (*processStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// command name might contain spaces, so fields are counted after it
+	commEnd := strings.LastIndexByte(string(data), ')')
+	if commEnd == -1 {
+		return nil, fmt.Errorf("wrong format of /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[commEnd+1:]))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("wrong format of /proc/%d/stat", pid)
+	}
+	// fields[0] is state which is field 3 in proc(5) numbering
+	field := func(number int) int64 {
+		index := number - 3
+		if index >= len(fields) {
+			return 0
+		}
+		value, _ := strconv.ParseInt(fields[index], 10, 64)
+		return value
+	}
+	utime := field(14)
+	stime := field(15)
+	return &processStat{
+		state:      fields[0][0],
+		startTicks: field(22),
+		cpuTime:    float64(utime+stime) / clockTicksPerSecond,
+		threads:    int32(field(20)),
+		rssBytes:   field(24) * int64(os.Getpagesize()),
+	}, nil
+}
+
+func countOpenFiles(pid int) int32 {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	return int32(len(entries))
+}
+
+// readCgroupIO sums bytes read and written by all cgroup processes on all devices
+func readCgroupIO(cgroupPath string) (readBytes, writeBytes int64, err error) {
+	data, err := os.ReadFile(path.Join(cgroupPath, "io.stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "rbytes=") {
+				bytes, _ := strconv.ParseInt(strings.TrimPrefix(field, "rbytes="), 10, 64)
+				readBytes += bytes
+			} else if strings.HasPrefix(field, "wbytes=") {
+				bytes, _ := strconv.ParseInt(strings.TrimPrefix(field, "wbytes="), 10, 64)
+				writeBytes += bytes
+			}
+		}
+	}
+	return readBytes, writeBytes, nil
+}
+
+// readProcessIO is used when service is not placed into cgroup
+func readProcessIO(pid int) (readBytes, writeBytes int64, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		bytes, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch name {
+		case "read_bytes":
+			readBytes = bytes
+		case "write_bytes":
+			writeBytes = bytes
+		}
+	}
+	return readBytes, writeBytes, nil
+}
+
+// ResourceUsage returns usage of running service process or nil if not running.
+// CPU percent is taken from the latest sample of resource usage collector.
+func (service *Service) ResourceUsage() *ResourceUsage {
+	result, pid := service.readResourceUsage()
+	if result == nil {
+		return nil
+	}
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	if service.lastCpuSample.pid == pid {
+		result.CpuPercent = service.cpuPercent
+	}
+	return result
+}
+
+// sampleCpu measures CPU percent of running process since previous sample
+// or since process start for the first one
+func (service *Service) sampleCpu() {
+	result, pid := service.readResourceUsage()
+	now := time.Now()
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if result == nil {
+		service.lastCpuSample = cpuSample{}
+		service.cpuPercent = 0
+		return
+	}
+	previous := service.lastCpuSample
+	service.lastCpuSample = cpuSample{pid: pid, cpuTime: result.CpuTimeSec, at: now}
+	var wallTime, cpuTime float64
+	if previous.pid == pid {
+		wallTime = now.Sub(previous.at).Seconds()
+		cpuTime = result.CpuTimeSec - previous.cpuTime
+	} else {
+		wallTime = float64(now.Unix() - service.StartTime)
+		cpuTime = result.CpuTimeSec
+	}
+	service.cpuPercent = 0
+	if wallTime > 0 {
+		service.cpuPercent = 100 * cpuTime / wallTime
+	}
+}
+
+// collectResourceUsage samples CPU usage of all services periodically,
+// so all status requests get the same values regardless of their rate
+func (service *SupervisorService) collectResourceUsage() {
+	for range time.Tick(cpuSampleInterval) {
+		service.WebServer.sampleCpu()
+		for _, instance := range service.instancesList() {
+			for _, instanceService := range instance.services() {
+				if instanceService != nil {
+					instanceService.sampleCpu()
+				}
+			}
+		}
+	}
+}
+
+// CumulativeResourceUsage returns usage of running service process without
+// CPU percent, it does not affect measurements of ResourceUsage
+func (service *Service) CumulativeResourceUsage() *ResourceUsage {
+	result, _ := service.readResourceUsage()
+	return result
+}
+
+func (service *Service) readResourceUsage() (*ResourceUsage, int) {
+	service.mutex.RLock()
+	process := service.process
+	cgroupPath := service.CgroupPath
+	service.mutex.RUnlock()
+	if process == nil {
+		return nil, 0
+	}
+	pid := process.Pid
+	stat, err := readProcessStat(pid)
+	if err != nil {
+		return nil, 0
+	}
+	result := &ResourceUsage{
+		MemoryRssBytes: stat.rssBytes,
+		CpuTimeSec:     stat.cpuTime,
+		OpenFds:        countOpenFiles(pid),
+		Threads:        stat.threads,
+	}
+	if cgroupPath != "" {
+		result.IoReadBytes, result.IoWriteBytes, err = readCgroupIO(cgroupPath)
+	}
+	if cgroupPath == "" || err != nil {
+		result.IoReadBytes, result.IoWriteBytes, _ = readProcessIO(pid)
+	}
+	return result, pid
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// serviceRestartPolicy returns global restart policy with fields
+// overridden by instance configuration for specified service
+func serviceRestartPolicy(globalConfig *ServerConfig, config *SupervisorConfig, serviceName string) RestartPolicyConf {
+	policy := globalConfig.RestartPolicy
+	if config == nil {
+		return policy
+	}
+	if override, present := config.RestartPolicies[serviceName]; present {
+		// override was validated while loading configuration
+		json.Unmarshal(override, &policy)
+	}
+	return policy
+}
+
+func (policy RestartPolicyConf) validate() error {
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("jitter %v is out of range [0, 1]", policy.Jitter)
+	}
+	return nil
+}
+
+// validateRestartPolicyOverride checks fields present in restart policy override
+func validateRestartPolicyOverride(override json.RawMessage) error {
+	policy := RestartPolicyConf{}
+	if err := json.Unmarshal(override, &policy); err != nil {
+		return err
+	}
+	return policy.validate()
+}
+
+// restartDelay returns interval before restart attempt (counted from 0)
+func restartDelay(policy RestartPolicyConf, attempt int) time.Duration {
+	maxInterval := float64(policy.MaxIntervalMs)
+	interval := float64(policy.RestartIntervalMs)
+	if attempt >= policy.MaxTries {
+		// never giving up service restarts slowly
+		interval = maxInterval
+	} else if policy.BackoffMultiplier > 1 {
+		interval *= math.Pow(policy.BackoffMultiplier, float64(attempt))
+	}
+	if maxInterval > 0 && interval > maxInterval {
+		interval = maxInterval
+	}
+	if policy.Jitter > 0 {
+		interval += interval * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+// resetRestartsIfStable forgets previous restart attempts if service was
+// running long enough before exit
+func (service *Service) resetRestartsIfStable() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	uptime := time.Now().Unix() - service.StartTime
+	if uptime >= int64(service.RestartPolicy.ResetAfterSec) {
+		service.restartAttempts = 0
+	}
+}
+
+func (service *Service) canRespawn() bool {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	return service.RestartPolicy.NeverGiveUp || service.restartAttempts < service.RestartPolicy.MaxTries
+}
+
+// respawn restarts service according to restart policy until process started,
+// restart attempts exhausted or service stopped. Returns true if process started.
+func (service *Service) respawn() bool {
+	// forget wakeups requested before process exit
+	select {
+	case <-service.respawnWakeup:
+	default:
+	}
+	for {
+		service.mutex.RLock()
+		attempt := service.restartAttempts
+		policy := service.RestartPolicy
+		service.mutex.RUnlock()
+		delay := restartDelay(policy, attempt)
+		message := fmt.Sprintf("restart attempt %d of %d in %v", attempt+1, policy.MaxTries, delay.Round(time.Millisecond))
+		if attempt >= policy.MaxTries {
+			message = fmt.Sprintf("restart attempt %d in %v, never giving up", attempt+1, delay.Round(time.Millisecond))
+		}
+		service.recordEvent(&ServiceEvent{Type: ServiceEventType_EVENT_RESTART_SCHEDULED, Message: message})
+		if !service.waitRestart(delay) {
+			service.logger().Infof("service %s@%s stopped while waiting for restart", service.ServiceName, service.InstanceName)
+			return false
+		}
+		service.mutex.Lock()
+		service.restartAttempts++
+		service.mutex.Unlock()
+		service.startProcess()
+		service.mutex.RLock()
+		started := service.process != nil
+		service.mutex.RUnlock()
+		if started {
+			return true
+		}
+		if !service.canRespawn() {
+			service.recordEvent(&ServiceEvent{
+				Type:    ServiceEventType_EVENT_GAVE_UP,
+				Message: "restart attempts limit reached",
+			})
+			service.closeListener()
+			return false
+		}
+		service.mutex.Lock()
+		service.setStatus(ServiceStatus_RESPAWNING)
+		service.mutex.Unlock()
+	}
+}
+
+// waitRestart sleeps before restart attempt, returns false if service
+// was stopped meanwhile
+func (service *Service) waitRestart(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-service.respawnWakeup:
+	}
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	return service.Status == ServiceStatus_RESPAWNING
+}
+
+// cancelRespawn stops service waiting for restart, returns false if service is not respawning
+func (service *Service) cancelRespawn() bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.Status != ServiceStatus_RESPAWNING || service.process != nil {
+		return false
+	}
+	service.setStatus(ServiceStatus_STOPPED)
+	select {
+	case service.respawnWakeup <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Reset clears DEAD or FAILED state and restart counters so service might be started again
+func (service *Service) Reset() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.Status != ServiceStatus_DEAD && service.Status != ServiceStatus_FAILED {
+		return
+	}
+	service.Error = ""
+	service.restartAttempts = 0
+	service.CrashesSinceStart = 0
+	service.setStatus(ServiceStatus_STOPPED)
+}
+
+func (service *SupervisorService) Reset(ctx context.Context, request *ResetRequest) (*StatusResponse, error) {
+	if len(request.ServiceNames) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "service names required")
+	}
+	services, err := service.findServices(request.InstanceName, request.ServiceNames)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range services {
+		target.Reset()
+		target.logger().Infof("service %s@%s state reset", target.ServiceName, target.InstanceName)
+	}
+	return service.GetStatus(ctx, &StatusRequest{InstanceName: request.InstanceName})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// processFinished reports if child process exited even if it was not waited yet
+func processFinished(pid int) bool {
+	stat, err := readProcessStat(pid)
+	return err != nil || stat.state == 'Z' || stat.state == 'X'
+}
+
+// waitSocketTakenOver blocks until process recreates socket file replacing
+// previous one (any file if previous is nil) and accepts gRPC connections on it
+func waitSocketTakenOver(sockFile string, previous os.FileInfo, pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastError := fmt.Errorf("socket %s was not recreated", sockFile)
+	for {
+		if processFinished(pid) {
+			return fmt.Errorf("process exited")
+		}
+		current, err := os.Stat(sockFile)
+		if err == nil && (previous == nil || !os.SameFile(previous, current)) {
+			if _, lastError = probeSocket(sockFile, readinessProbeInterval); lastError == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready within %v: %v", timeout, lastError)
+		}
+		time.Sleep(readinessProbeInterval)
+	}
+}
+
+// Replace restarts running service without downtime. New process is started
+// next to old one and takes over socket file, old process is terminated only
+// after new one accepts connections. Services without socket are just restarted.
+func (service *Service) Replace(readyTimeout time.Duration) error {
+	service.mutex.Lock()
+	oldProcess := service.process
+	serviceStatus := service.Status
+	sockFile := service.SockFile
+	notifyReady := service.NotifyReady
+	if serviceStatus != ServiceStatus_RUNNING || oldProcess == nil {
+		service.mutex.Unlock()
+		return fmt.Errorf("service is %v", serviceStatus)
+	}
+	if service.replacing {
+		service.mutex.Unlock()
+		return fmt.Errorf("service restart already in progress")
+	}
+	service.replacing = true
+	oldStartTime := service.StartTime
+	shutdownTimeout := service.ShutdownTimeout
+	service.mutex.Unlock()
+	defer func() {
+		service.mutex.Lock()
+		service.replacing = false
+		service.mutex.Unlock()
+	}()
+
+	if sockFile == "" {
+		service.Stop()
+		service.Start()
+		return service.WaitReady(readyTimeout)
+	}
+
+	// socket activated processes share the same socket, others create new one
+	socketActivated := service.socketActivated()
+	previousSocket, _ := os.Stat(sockFile)
+	newProcess, outputCapture, err := service.spawnProcess()
+	if err != nil {
+		return fmt.Errorf("cant start new process: %v", err)
+	}
+	service.eventLogger(ServiceEventType_EVENT_STARTED, newProcess.Pid).Infof("started replacement of service %s@%s (pid=%v) with pid %v",
+		service.ServiceName, service.InstanceName, oldProcess.Pid, newProcess.Pid)
+	if socketActivated {
+		err = waitActivatedReady(sockFile, newProcess.Pid, readyTimeout)
+	} else {
+		err = waitSocketTakenOver(sockFile, previousSocket, newProcess.Pid, readyTimeout)
+	}
+	if err == nil && notifyReady {
+		err = service.waitNotifyReady(newProcess.Pid, readyTimeout)
+	}
+	if err != nil {
+		newProcess.Kill()
+		newProcess.Wait()
+		current, statError := os.Stat(sockFile)
+		if socketActivated || statError == nil && previousSocket != nil && os.SameFile(previousSocket, current) {
+			service.logger().Warningf("replacement of service %s@%s failed: %v, old process kept running",
+				service.ServiceName, service.InstanceName, err)
+			return fmt.Errorf("new process failed: %v, old process kept running", err)
+		}
+		// new process removed socket file of old one, so restart it in place
+		service.logger().Warningf("replacement of service %s@%s failed: %v, restarting it",
+			service.ServiceName, service.InstanceName, err)
+		service.Stop()
+		service.Start()
+		return fmt.Errorf("new process failed: %v, service restarted in place", err)
+	}
+
+	service.mutex.Lock()
+	if service.process != oldProcess || service.Status != ServiceStatus_RUNNING {
+		service.mutex.Unlock()
+		newProcess.Kill()
+		newProcess.Wait()
+		return fmt.Errorf("service state changed while replacing process")
+	}
+	service.process = newProcess
+	service.adoptedStartTicks = 0
+	service.outputCapture = outputCapture
+	service.StartTime = time.Now().Unix()
+	service.healthState = HealthState_HEALTH_UNKNOWN
+	service.failedProbes = 0
+	service.resetNotifications()
+	// status is still RUNNING, but watchers must know new pid
+	service.publishStatus()
+	service.mutex.Unlock()
+	service.recordEvent(&ServiceEvent{
+		Type:    ServiceEventType_EVENT_STARTED,
+		Pid:     int32(newProcess.Pid),
+		Message: fmt.Sprintf("replacing pid %d", oldProcess.Pid),
+	})
+	go service.monitorProcess()
+
+	service.logger().WithField("pid", oldProcess.Pid).Infof("terminating replaced process of service %s@%s (pid=%v)",
+		service.ServiceName, service.InstanceName, oldProcess.Pid)
+	oldProcess.Signal(syscall.SIGTERM)
+	timeout := time.After(time.Duration(shutdownTimeout) * time.Second)
+	for oldProcess.Signal(syscall.Signal(0)) == nil {
+		select {
+		case <-timeout:
+			service.logger().WithField("pid", oldProcess.Pid).Warningf("killing replaced process of service %s@%s (pid=%v) after terminate attempt not finished within %v seconds",
+				service.ServiceName, service.InstanceName, oldProcess.Pid, shutdownTimeout)
+			oldProcess.Kill()
+			timeout = nil
+		case <-time.After(readinessProbeInterval):
+		}
+	}
+	service.recordEvent(&ServiceEvent{
+		Type:    ServiceEventType_EVENT_STOPPED,
+		Pid:     int32(oldProcess.Pid),
+		Uptime:  time.Now().Unix() - oldStartTime,
+		Message: fmt.Sprintf("replaced by pid %d", newProcess.Pid),
+	})
+
+	// old process removes pid file on exit
+	service.mutex.RLock()
+	pidFile := service.PidFile
+	exitListener := service.exitListener
+	service.mutex.RUnlock()
+	if pidFile != "" {
+		os.WriteFile(pidFile, []byte(strconv.Itoa(newProcess.Pid)+"\n"), 0o664)
+	}
+	// old process must not remove socket file taken over by new one
+	if err := waitSocketTakenOver(sockFile, nil, newProcess.Pid, readyTimeout); err != nil {
+		service.logger().Warningf("service %s@%s does not answer after replaced process exited: %v, restarting it",
+			service.ServiceName, service.InstanceName, err)
+		service.Stop()
+		service.Start()
+		return fmt.Errorf("new process does not answer: %v, service restarted in place", err)
+	}
+	// clients connected to old process must reconnect
+	exitListener(service.InstanceName, service.ServiceName)
+	return nil
+}
+
+// RollingRestart replaces running services one by one so that each one is ready
+// before next is restarted. Master services are restarted in dependency order,
+// graders are last ones. Stops at first failed service.
+func (instance *Instance) RollingRestart(names []string, report func(serviceName, message string)) error {
+	if len(names) == 0 {
+		for _, serviceStatus := range instance.GetServiceStatuses() {
+			if serviceStatus.Status == ServiceStatus_RUNNING {
+				names = append(names, serviceStatus.ServiceName)
+			}
+		}
+	}
+	names = instance.expandServiceNames(names)
+	requested := make(map[string]bool, len(names))
+	masterServices := make([]string, 0, len(names))
+	graders := make([]string, 0, len(names))
+	for _, serviceName := range names {
+		requested[serviceName] = true
+		if isGraderService(serviceName) {
+			graders = append(graders, serviceName)
+		} else {
+			masterServices = append(masterServices, serviceName)
+		}
+	}
+	restartOrder, err := instance.resolveStartOrder(masterServices)
+	if err != nil {
+		return err
+	}
+	restartOrder = append(restartOrder, graders...)
+	readyTimeout := time.Duration(instance.globalConfig().StartTimeout) * time.Second
+	for _, serviceName := range restartOrder {
+		service := instance.service(serviceName)
+		if !requested[serviceName] || service == nil {
+			continue
+		}
+		if serviceStatus := service.GetStatus().Status; serviceStatus != ServiceStatus_RUNNING {
+			report(serviceName, fmt.Sprintf("skipped, service is %v", serviceStatus))
+			continue
+		}
+		report(serviceName, "restarting")
+		if err := service.Replace(readyTimeout); err != nil {
+			return fmt.Errorf("cant restart %s: %v", serviceName, err)
+		}
+		report(serviceName, fmt.Sprintf("restarted with pid %d", service.GetStatus().Pid))
+	}
+	return nil
+}
+
+func (service *SupervisorService) RollingRestart(request *RollingRestartRequest, stream Supervisor_RollingRestartServer) error {
+	report := func(serviceName, message string) {
+		stream.Send(&RollingRestartProgress{ServiceName: serviceName, Message: message})
+	}
+	if request.InstanceName == "web" || request.InstanceName == "webserver" || request.InstanceName == "grpcwebserver" {
+		readyTimeout := time.Duration(service.config().StartTimeout) * time.Second
+		report("webserver", "restarting")
+		if err := service.WebServer.Replace(readyTimeout); err != nil {
+			return status.Errorf(codes.Aborted, "cant restart webserver: %v", err)
+		}
+		report("webserver", fmt.Sprintf("restarted with pid %d", service.WebServer.GetStatus().Pid))
+		return nil
+	}
+	instance, instanceFound := service.getInstance(request.InstanceName)
+	if !instanceFound {
+		return status.Errorf(codes.NotFound, "instance %s not found", request.InstanceName)
+	}
+	for _, serviceName := range request.ServiceNames {
+		if instance.service(serviceName) == nil {
+			return status.Errorf(codes.NotFound, "service %s not found in instance %s", serviceName, request.InstanceName)
+		}
+	}
+	instance.logger().Infof("rolling restart of instance %s requested", instance.Name)
+	if err := instance.RollingRestart(request.ServiceNames, report); err != nil {
+		return status.Errorf(codes.Aborted, "rolling restart of instance %s stopped: %v", instance.Name, err)
+	}
+	return nil
+}
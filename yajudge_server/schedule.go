@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleRestart     = "restart"
+	scheduleStop        = "stop"
+	scheduleStart       = "start"
+	scheduleMaintenance = "maintenance"
+)
+
+type ScheduleConf struct {
+	// restart, stop, start or maintenance
+	Action string `yaml:"action" json:"action"`
+	// minute, hour, day of month, month and day of week in local time
+	Cron string `yaml:"cron" json:"cron"`
+	// services to restart, stop or start, all running or autostart services if empty
+	Services []string `yaml:"services" json:"services"`
+	// length of maintenance window
+	DurationMin int `yaml:"duration_min" json:"duration_min"`
+	// shown on maintenance page of instance site
+	Message string `yaml:"message" json:"message"`
+
+	cron *cronSchedule
+}
+
+// maintenanceMergeLimit is how far ahead adjacent maintenance windows are merged
+const maintenanceMergeLimit = 7 * 24 * time.Hour
+
+// maintenanceState is written for webserver to serve maintenance page of instance site
+type maintenanceState struct {
+	Until   time.Time `json:"until"`
+	Message string    `json:"message"`
+}
+
+func (config *SupervisorConfig) parseSchedules() error {
+	for index := range config.Schedules {
+		schedule := &config.Schedules[index]
+		cron, err := parseCron(schedule.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule %d: %v", index+1, err)
+		}
+		schedule.cron = cron
+		switch schedule.Action {
+		case scheduleRestart, scheduleStop, scheduleStart:
+		case scheduleMaintenance:
+			if schedule.DurationMin <= 0 {
+				return fmt.Errorf("schedule %d: no duration_min set for maintenance", index+1)
+			}
+			if len(schedule.Services) > 0 {
+				return fmt.Errorf("schedule %d: maintenance applies to whole instance, services must not be set", index+1)
+			}
+		default:
+			return fmt.Errorf("schedule %d: unknown action '%s'", index+1, schedule.Action)
+		}
+	}
+	return nil
+}
+
+// maintenanceWindow returns end of maintenance window active at given time,
+// overlapping and adjacent windows are merged
+func (instance *Instance) maintenanceWindow(now time.Time) (until time.Time, message string, active bool) {
+	for _, schedule := range instance.config().Schedules {
+		if schedule.Action != scheduleMaintenance {
+			continue
+		}
+		duration := time.Duration(schedule.DurationMin) * time.Minute
+		start, found := schedule.cron.next(now.Add(-duration))
+		if !found || start.After(now) {
+			continue
+		}
+		end := start.Add(duration)
+		for {
+			following, found := schedule.cron.next(start)
+			if !found || following.After(end) || following.Sub(now) > maintenanceMergeLimit {
+				break
+			}
+			start = following
+			end = following.Add(duration)
+		}
+		if end.After(until) {
+			until = end
+			message = schedule.Message
+			active = true
+		}
+	}
+	return until, message, active
+}
+
+// MaintenanceUntil returns end of current maintenance window, zero if there is no one
+func (instance *Instance) MaintenanceUntil() time.Time {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.maintenanceUntil
+}
+
+// ScheduledActions returns next run of each instance schedule ordered by time
+func (instance *Instance) ScheduledActions(now time.Time) []*ScheduledAction {
+	result := make([]*ScheduledAction, 0)
+	for _, schedule := range instance.config().Schedules {
+		next, found := schedule.cron.next(now)
+		if !found {
+			continue
+		}
+		action := &ScheduledAction{
+			Action:       schedule.Action,
+			ServiceNames: schedule.Services,
+			Time:         next.Unix(),
+		}
+		if schedule.Action == scheduleMaintenance {
+			action.Until = next.Add(time.Duration(schedule.DurationMin) * time.Minute).Unix()
+		}
+		result = append(result, action)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time < result[j].Time
+	})
+	return result
+}
+
+func (instance *Instance) runScheduledAction(schedule ScheduleConf) {
+	target := "all services"
+	if len(schedule.Services) > 0 {
+		target = strings.Join(schedule.Services, ", ")
+	}
+	if !instance.MaintenanceUntil().IsZero() {
+		instance.logger().Infof("scheduled %s of %s in instance %s skipped during maintenance", schedule.Action, target, instance.Name)
+		return
+	}
+	instance.logger().Infof("scheduled %s of %s in instance %s", schedule.Action, target, instance.Name)
+	switch schedule.Action {
+	case scheduleRestart:
+		err := instance.RollingRestart(slices.Clone(schedule.Services), func(serviceName, message string) {
+			instance.logger().WithField("service", serviceName).Infof("scheduled restart of %s@%s: %s", serviceName, instance.Name, message)
+		})
+		if err != nil {
+			instance.logger().Errorf("scheduled restart of instance %s failed: %v", instance.Name, err)
+		}
+	case scheduleStop:
+		instance.Stop(slices.Clone(schedule.Services))
+	case scheduleStart:
+		instance.Start(slices.Clone(schedule.Services))
+	}
+}
+
+// maintenanceDir is where webserver finds maintenance state of instance sites,
+// see maintenance_dir in webserver.yaml
+func (service *SupervisorService) maintenanceDir() string {
+	return path.Join(service.config().PidFileDir, "maintenance")
+}
+
+// setSiteMaintenance switches maintenance page of instance site served by webserver
+func (service *SupervisorService) setSiteMaintenance(instanceName string, state *maintenanceState) {
+	fileName := path.Join(service.maintenanceDir(), instanceName)
+	if state == nil {
+		os.Remove(fileName)
+	} else {
+		content, _ := json.Marshal(state)
+		os.MkdirAll(path.Dir(fileName), 0o775)
+		if err := os.WriteFile(fileName, content, 0o664); err != nil {
+			log.Errorf("cant enable maintenance page of instance %s: %v", instanceName, err)
+		}
+	}
+	if service.WebServer.GetStatus().Status == ServiceStatus_RUNNING {
+		message := fmt.Sprintf("INSTANCE=%s\nMAINTENANCE=reload\n", instanceName)
+		if err := service.WebServer.SendControlMessage(message); err != nil {
+			service.WebServer.SendSIGHUP()
+		}
+	}
+}
+
+// updateMaintenance stops instance when its maintenance window begins
+// and starts it again after the window is over
+func (service *SupervisorService) updateMaintenance(instance *Instance, now time.Time) {
+	until, message, active := instance.maintenanceWindow(now)
+	instance.mutex.Lock()
+	wasActive := !instance.maintenanceUntil.IsZero()
+	if active {
+		instance.maintenanceUntil = until
+	} else {
+		instance.maintenanceUntil = time.Time{}
+	}
+	instance.mutex.Unlock()
+	if active && !wasActive {
+		instance.logger().Infof("maintenance of instance %s until %v, stopping it", instance.Name, until.Format(time.RFC3339))
+		service.setSiteMaintenance(instance.Name, &maintenanceState{Until: until, Message: message})
+		go instance.Stop([]string{})
+	} else if !active && wasActive {
+		instance.logger().Infof("maintenance of instance %s is over, starting it", instance.Name)
+		service.setSiteMaintenance(instance.Name, nil)
+		go instance.Start([]string{})
+	}
+}
+
+// processSchedules runs actions of all instances scheduled at given minute
+func (service *SupervisorService) processSchedules(now time.Time) {
+	for _, instance := range service.instancesList() {
+		service.updateMaintenance(instance, now)
+		for _, schedule := range instance.config().Schedules {
+			if schedule.Action != scheduleMaintenance && schedule.cron.matches(now) {
+				go instance.runScheduledAction(schedule)
+			}
+		}
+	}
+}
+
+// runScheduler checks schedules at the beginning of each minute
+func (service *SupervisorService) runScheduler() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		service.processSchedules(next)
+	}
+}
+
+// startScheduler puts instances being in maintenance at supervisor start
+// into maintenance before autostart and starts checking schedules
+func (service *SupervisorService) startScheduler() {
+	// maintenance pages of previous run are not valid anymore
+	os.RemoveAll(service.maintenanceDir())
+	now := time.Now()
+	for _, instance := range service.instancesList() {
+		service.updateMaintenance(instance, now)
+	}
+	go service.runScheduler()
+}
@@ -1,42 +1,103 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	readinessProbeInterval = 100 * time.Millisecond
+	outputCaptureTimeout   = 500 * time.Millisecond
+)
+
 type NotifyFunc func(instanceName, serviceName string)
 
+type StatusFunc func(instanceName string, status *ServiceStatusResponse)
+
 type Service struct {
 	InstanceName      string
 	ServiceName       string
 	Executable        string
+	Arguments         []string
+	ExtraArguments    []string
+	Environment       map[string]string
+	EnvironmentFiles  map[string]string
+	WorkingDir        string
+	Umask             string
+	User              string
+	Group             string
 	Status            ServiceStatus
 	Error             string
 	StartTime         int64
 	RestartPolicy     RestartPolicyConf
+	HealthCheck       HealthCheckConf
+	LogRotation       LogRotationConf
 	ShutdownTimeout   int
+	DrainTimeout      int
+	NotifyReady       bool
+	WatchdogSec       int
+	ResourceLimits    ResourceLimitsConf
+	SocketActivation  bool
+	ProcessAdoption   bool
+	CgroupRoot        string
+	CgroupPath        string
 	LogFile           string
 	PidFile           string
 	SockFile          string
+	Replica           int
 	CrashesSinceStart int
+	LastExitCode      int
 
 	mutex            sync.RWMutex
 	shutdownComplete chan interface{}
+	respawnWakeup    chan struct{}
 	restartAttempts  int
 	process          *os.Process
-	stdout           *os.File
-	stderr           *os.File
-	exitListener     NotifyFunc
+	replacing        bool
+	// service definition declares that process accepts LISTEN_FDS
+	socketActivationSupported bool
+	// start time of process not being supervisor child, see Adopt
+	adoptedStartTicks int64
+	listener          *net.UnixListener
+	logWriter         *RotatingFile
+
+	outputSubscribers map[outputSubscriber]bool
+	exitListener      NotifyFunc
+	statusListener    StatusFunc
+
+	healthState         HealthState
+	probeLatency        time.Duration
+	failedProbes        int
+	healthMonitorActive bool
+
+	notifyConn            *net.UnixConn
+	readyPid              int
+	statusText            string
+	lastWatchdog          time.Time
+	watchdogMonitorActive bool
+
+	lastCpuSample cpuSample
+	cpuPercent    float64
+
+	events        eventHistory
+	stderrTail    []string
+	outputCapture *sync.WaitGroup
 }
 
 func NewService(instanceName, serviceName, executable, logFile, pidFile, sockFile string,
 	initialStatus ServiceStatus,
 	restartPolicy RestartPolicyConf,
+	healthCheck HealthCheckConf,
+	logRotation LogRotationConf,
 	shutdownTimeout int,
 	processExitListener NotifyFunc,
 ) *Service {
@@ -48,18 +109,26 @@ func NewService(instanceName, serviceName, executable, logFile, pidFile, sockFil
 		PidFile:          pidFile,
 		SockFile:         sockFile,
 		RestartPolicy:    restartPolicy,
+		HealthCheck:      healthCheck,
+		LogRotation:      logRotation,
 		Status:           initialStatus,
 		ShutdownTimeout:  shutdownTimeout,
 		shutdownComplete: make(chan interface{}),
+		respawnWakeup:    make(chan struct{}, 1),
 		exitListener:     processExitListener,
 	}
 	return result
 }
 
 func (service *Service) GetStatus() *ServiceStatusResponse {
-	var uptime int64
 	service.mutex.RLock()
 	defer service.mutex.RUnlock()
+	return service.statusSnapshot()
+}
+
+// statusSnapshot must be called with mutex locked
+func (service *Service) statusSnapshot() *ServiceStatusResponse {
+	var uptime int64
 	if service.Status == ServiceStatus_RUNNING {
 		uptime = time.Now().Unix() - service.StartTime
 	}
@@ -74,12 +143,24 @@ func (service *Service) GetStatus() *ServiceStatusResponse {
 		Pid:               int32(pid),
 		Uptime:            uptime,
 		CrashesSinceStart: int32(service.CrashesSinceStart),
+		Health:            service.healthState,
+		ProbeLatencyUs:    service.probeLatency.Microseconds(),
+		StatusText:        service.statusText,
 	}
 }
 
 func (service *Service) Start() {
 	service.mutex.RLock()
-	if service.Status == ServiceStatus_RUNNING {
+	if service.Status == ServiceStatus_RUNNING || service.Status == ServiceStatus_DRAINING {
+		service.mutex.RUnlock()
+		return
+	}
+	if service.Status == ServiceStatus_RESPAWNING {
+		// do not wait for next restart attempt
+		select {
+		case service.respawnWakeup <- struct{}{}:
+		default:
+		}
 		service.mutex.RUnlock()
 		return
 	}
@@ -91,12 +172,15 @@ func (service *Service) Start() {
 	service.startProcess()
 	if service.process != nil {
 		service.mutex.RLock()
-		log.Infof("started service %s@%s running with pid %v", service.ServiceName, service.InstanceName, service.process.Pid)
+		service.eventLogger(ServiceEventType_EVENT_STARTED, service.process.Pid).Infof("started service %s@%s running with pid %v", service.ServiceName, service.InstanceName, service.process.Pid)
 		service.mutex.RUnlock()
+		go service.checkFilesPermissions()
 		go service.monitorProcess()
+		service.startHealthMonitor()
+		service.startWatchdogMonitor()
 	} else {
 		service.mutex.RLock()
-		log.Warningf("cant start service %s@%s", service.ServiceName, service.InstanceName)
+		service.eventLogger(ServiceEventType_EVENT_START_FAILED, 0).Warningf("cant start service %s@%s", service.ServiceName, service.InstanceName)
 		service.mutex.RUnlock()
 	}
 }
@@ -108,9 +192,103 @@ func (service *Service) Stop() {
 		return
 	}
 	service.mutex.RUnlock()
+	if service.cancelRespawn() {
+		service.logger().Infof("service %s@%s restart cancelled", service.ServiceName, service.InstanceName)
+		service.closeListener()
+		return
+	}
 	service.stopProcess()
 }
 
+// UpdatePolicies applies changed configuration to service without restart
+func (service *Service) UpdatePolicies(restartPolicy RestartPolicyConf, healthCheck HealthCheckConf,
+	logRotation LogRotationConf, shutdownTimeout int,
+) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.RestartPolicy = restartPolicy
+	service.HealthCheck = healthCheck
+	service.LogRotation = logRotation
+	service.ShutdownTimeout = shutdownTimeout
+	if service.logWriter != nil {
+		service.logWriter.SetConfig(logRotation)
+	}
+}
+
+// SetEnabled switches service between DISABLED and STOPPED states,
+// service must be stopped before disabling
+func (service *Service) SetEnabled(enabled bool) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if enabled && service.Status == ServiceStatus_DISABLED {
+		service.setStatus(ServiceStatus_STOPPED)
+	}
+	if !enabled && service.process == nil {
+		service.setStatus(ServiceStatus_DISABLED)
+	}
+}
+
+// SetFailed marks service which has no process as failed, running process
+// is kept visible to status, health and watchdog monitors. Returns false
+// if service is running so its status was not changed.
+func (service *Service) SetFailed(reason string) bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.process != nil {
+		return false
+	}
+	service.Error = reason
+	service.setStatus(ServiceStatus_FAILED)
+	return true
+}
+
+// WaitReady blocks until service socket accepts gRPC connections or service
+// sends READY=1 if it uses notifications. Services without socket (grader,
+// webserver) are ready as soon as running.
+func (service *Service) WaitReady(timeout time.Duration) error {
+	service.mutex.RLock()
+	sockFile := service.SockFile
+	notifyReady := service.NotifyReady
+	service.mutex.RUnlock()
+	deadline := time.Now().Add(timeout)
+	var lastError error
+	for {
+		service.mutex.RLock()
+		status := service.Status
+		failReason := service.Error
+		service.mutex.RUnlock()
+		if status != ServiceStatus_RUNNING && status != ServiceStatus_RESPAWNING {
+			if failReason != "" {
+				return fmt.Errorf("service is %v: %s", status, failReason)
+			}
+			return fmt.Errorf("service is %v", status)
+		}
+		if status == ServiceStatus_RUNNING && notifyReady {
+			service.mutex.RLock()
+			ready := service.notifiedReady()
+			service.mutex.RUnlock()
+			if ready {
+				return nil
+			}
+			lastError = fmt.Errorf("READY=1 not received")
+		} else if status == ServiceStatus_RUNNING {
+			if sockFile == "" {
+				return nil
+			}
+			if _, lastError = probeSocket(sockFile, readinessProbeInterval); lastError == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if lastError != nil {
+				return fmt.Errorf("not ready within %v: %v", timeout, lastError)
+			}
+			return fmt.Errorf("not ready within %v", timeout)
+		}
+		time.Sleep(readinessProbeInterval)
+	}
+}
+
 func (service *Service) checkFilesPermissions() {
 	for {
 		time.Sleep(time.Duration(250) * time.Millisecond)
@@ -130,56 +308,74 @@ func (service *Service) checkFilesPermissions() {
 }
 
 func (service *Service) monitorProcess() {
-	go service.checkFilesPermissions()
 	for {
 		service.mutex.RLock()
 		process := service.process
+		adoptedStartTicks := service.adoptedStartTicks
 		service.mutex.RUnlock()
-		processState, _ := process.Wait()
-
+		var processState *os.ProcessState
+		if adoptedStartTicks != 0 {
+			// exit status of not child process is unknown
+			waitAdoptedProcess(process.Pid, adoptedStartTicks)
+		} else {
+			processState, _ = process.Wait()
+		}
 		service.mutex.RLock()
+		replaced := service.process != process && service.process != nil
+		service.mutex.RUnlock()
+		if replaced {
+			// rolling restart took care of old process and monitors new one
+			service.logger().WithField("pid", process.Pid).Infof("replaced process of service %s@%s (pid=%v) finished",
+				service.ServiceName, service.InstanceName, process.Pid)
+			break
+		}
+		service.waitOutputCaptured()
+
+		service.mutex.Lock()
+		if processState != nil {
+			service.LastExitCode = processState.ExitCode()
+		}
 		serviceStatus := service.Status
 		exitListener := service.exitListener
-		service.mutex.RUnlock()
+		service.mutex.Unlock()
 		exitListener(service.InstanceName, service.ServiceName)
+		service.resetRestartsIfStable()
 		mustStopMonitor := true
-		if serviceStatus == ServiceStatus_SHUTDOWN {
-			log.Infof("service %s@%s shut down", service.ServiceName, service.InstanceName)
+		if serviceStatus == ServiceStatus_DRAINING {
+			service.eventLogger(ServiceEventType_EVENT_STOPPED, process.Pid).Infof("service %s@%s drained", service.ServiceName, service.InstanceName)
+			service.recordEvent(service.exitEvent(ServiceEventType_EVENT_STOPPED, process.Pid, processState))
+			service.mutex.Lock()
+			service.process = nil
+			service.setStatus(ServiceStatus_STOPPED)
+			service.mutex.Unlock()
+			service.cleanFiles()
+		} else if serviceStatus == ServiceStatus_SHUTDOWN {
+			service.eventLogger(ServiceEventType_EVENT_STOPPED, process.Pid).Infof("service %s@%s shut down", service.ServiceName, service.InstanceName)
+			service.recordEvent(service.exitEvent(ServiceEventType_EVENT_STOPPED, process.Pid, processState))
 			service.cleanFiles()
 			service.shutdownComplete <- 1
 		} else if service.canRespawn() {
+			service.recordEvent(service.exitEvent(ServiceEventType_EVENT_EXITED, process.Pid, processState))
 			service.mutex.Lock()
-			stdoutData, _ := io.ReadAll(service.stdout)
-			stderrData, _ := io.ReadAll(service.stderr)
-			service.stdout.Close()
-			service.stderr.Close()
-			service.stdout = nil
-			service.stderr = nil
-			log.Warningf("service %s@%s dead with status %v, trying to restart",
-				service.ServiceName, service.InstanceName, processState.ExitCode())
-			if stdoutData != nil && len(stdoutData) > 0 {
-				log.Warningf("stdout before death: %s", string(stdoutData))
-			}
-			if stderrData != nil && len(stderrData) > 0 {
-				log.Warningf("stderr before death: %s", string(stderrData))
-			}
-			service.Status = ServiceStatus_RESPAWNING
+			service.eventLogger(ServiceEventType_EVENT_EXITED, process.Pid).Warningf("service %s@%s dead with status %v, trying to restart, see %s for details",
+				service.ServiceName, service.InstanceName, processState.ExitCode(), service.LogFile)
 			service.CrashesSinceStart++
 			service.process = nil
+			service.setStatus(ServiceStatus_RESPAWNING)
 			service.mutex.Unlock()
 			service.cleanFiles()
-			time.Sleep(time.Duration(service.RestartPolicy.RestartIntervalMs) * time.Millisecond)
-			service.mutex.Lock()
-			service.restartAttempts++
-			service.mutex.Unlock()
-			service.startProcess()
-			mustStopMonitor = false
+			mustStopMonitor = !service.respawn()
 		} else {
-			log.Warningf("service %s@%s dead with status %v",
+			service.eventLogger(ServiceEventType_EVENT_EXITED, process.Pid).Warningf("service %s@%s dead with status %v",
 				service.ServiceName, service.InstanceName, processState.ExitCode())
+			service.recordEvent(service.exitEvent(ServiceEventType_EVENT_EXITED, process.Pid, processState))
+			service.recordEvent(&ServiceEvent{
+				Type:    ServiceEventType_EVENT_GAVE_UP,
+				Message: "restart attempts limit reached",
+			})
 			service.mutex.Lock()
-			service.Status = ServiceStatus_DEAD
 			service.process = nil
+			service.setStatus(ServiceStatus_DEAD)
 			service.mutex.Unlock()
 			service.cleanFiles()
 		}
@@ -189,91 +385,241 @@ func (service *Service) monitorProcess() {
 	}
 }
 
-func (service *Service) canRespawn() bool {
-	uptime := time.Now().Unix() - service.StartTime
-	canResetCounter := uptime >= int64(service.RestartPolicy.ResetAfterSec)
-	if canResetCounter {
-		service.mutex.Lock()
-		service.restartAttempts = 0
-		service.mutex.Unlock()
-	}
-	service.mutex.RLock()
-	defer service.mutex.RUnlock()
-	return service.restartAttempts < service.RestartPolicy.MaxTries
-}
-
 func (service *Service) startProcess() {
-	executable, arguments := service.prepareArguments()
-	fds := make([]*os.File, 3)
 	service.mutex.Lock()
-	service.stdout, fds[1], _ = os.Pipe()
-	service.stderr, fds[2], _ = os.Pipe()
+	service.stderrTail = nil
 	service.mutex.Unlock()
-	process, err := os.StartProcess(executable, arguments, &os.ProcAttr{
-		Files: fds,
-	})
-	fds[1].Close()
-	fds[2].Close()
+	process, outputCapture, err := service.spawnProcess()
 	if err != nil {
 		service.mutex.Lock()
-		service.Status = ServiceStatus_FAILED
 		service.Error = err.Error()
 		service.process = nil
-		service.stderr.Close()
-		service.stderr.Close()
-		service.stdout = nil
-		service.stderr = nil
-		log.Warningf("failed to start %s@%s: %v",
+		service.setStatus(ServiceStatus_FAILED)
+		service.eventLogger(ServiceEventType_EVENT_START_FAILED, 0).Warningf("failed to start %s@%s: %v",
 			service.ServiceName, service.InstanceName, err)
 		service.mutex.Unlock()
+		service.recordEvent(&ServiceEvent{Type: ServiceEventType_EVENT_START_FAILED, Message: err.Error()})
 	} else {
+		service.recordEvent(&ServiceEvent{Type: ServiceEventType_EVENT_STARTED, Pid: int32(process.Pid)})
 		service.mutex.Lock()
-		service.Status = ServiceStatus_RUNNING
 		service.process = process
+		service.adoptedStartTicks = 0
+		service.outputCapture = outputCapture
 		service.Error = ""
 		service.StartTime = time.Now().Unix()
+		service.healthState = HealthState_HEALTH_UNKNOWN
+		service.failedProbes = 0
+		service.resetNotifications()
+		service.setStatus(ServiceStatus_RUNNING)
 		service.mutex.Unlock()
 	}
 }
 
+// spawnProcess starts service executable with its output captured into service log
+func (service *Service) spawnProcess() (*os.Process, *sync.WaitGroup, error) {
+	executable, arguments := service.prepareArguments()
+	secrets, err := service.secretEnvironment()
+	if err != nil {
+		return nil, nil, err
+	}
+	service.openLogWriter()
+	stdoutReader, stdoutWriter, stderrReader, stderrWriter, extraFiles, err := service.openOutputPipes()
+	if err != nil {
+		return nil, nil, err
+	}
+	service.mutex.RLock()
+	workingDir := service.WorkingDir
+	service.mutex.RUnlock()
+	attributes := &os.ProcAttr{
+		Dir:   workingDir,
+		Env:   append(append(service.processEnvironment(), secrets...), service.notifyEnvironment()...),
+		Files: []*os.File{nil, stdoutWriter, stderrWriter},
+	}
+	credential, err := service.credential()
+	attributes.Sys = &syscall.SysProcAttr{Credential: credential}
+	cgroupDir := service.openCgroup()
+	if cgroupDir != nil {
+		defer cgroupDir.Close()
+		attributes.Sys.UseCgroupFD = true
+		attributes.Sys.CgroupFD = int(cgroupDir.Fd())
+	}
+	service.mutex.RLock()
+	socketActivation := service.SocketActivation || service.listener != nil
+	service.mutex.RUnlock()
+	var socket *os.File
+	if socketActivation && err == nil {
+		socket, err = service.listenerFile()
+		if err == nil {
+			executable, arguments = passListener(executable, arguments, attributes, socket, service.ServiceName)
+		}
+	}
+	attributes.Files = append(attributes.Files, extraFiles...)
+	var process *os.Process
+	if err == nil {
+		process, err = os.StartProcess(executable, arguments, attributes)
+	}
+	attachLater := false
+	if cgroupDir != nil && (errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINVAL)) {
+		// kernel does not support CLONE_INTO_CGROUP
+		attributes.Sys.UseCgroupFD = false
+		attachLater = true
+		process, err = os.StartProcess(executable, arguments, attributes)
+	}
+	if socket != nil {
+		socket.Close()
+	}
+	for _, file := range extraFiles {
+		file.Close()
+	}
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdoutReader.Close()
+		stderrReader.Close()
+		return nil, nil, err
+	}
+	if attachLater {
+		service.attachCgroup(process.Pid)
+	}
+	outputCapture := &sync.WaitGroup{}
+	outputCapture.Add(2)
+	go service.captureOutput(stdoutReader, outputCapture, false)
+	go service.captureOutput(stderrReader, outputCapture, true)
+	return process, outputCapture, nil
+}
+
+func (service *Service) openLogWriter() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.logWriter != nil {
+		return
+	}
+	logWriter, err := OpenRotatingFile(service.LogFile, service.LogRotation)
+	if err != nil {
+		service.logger().Warningf("service %s@%s output will be written to supervisor log: %v",
+			service.ServiceName, service.InstanceName, err)
+		return
+	}
+	service.logWriter = logWriter
+}
+
+// captureOutput drains child process pipe line by line into service log
+// until process closes its end
+func (service *Service) captureOutput(pipe *os.File, captured *sync.WaitGroup, isStderr bool) {
+	defer captured.Done()
+	defer pipe.Close()
+	service.mutex.RLock()
+	logWriter := service.logWriter
+	service.mutex.RUnlock()
+	var writer io.Writer = logWriter
+	if logWriter == nil {
+		// each line becomes record of supervisor log
+		entryWriter := service.logger().WriterLevel(log.InfoLevel)
+		defer entryWriter.Close()
+		writer = entryWriter
+	}
+	reader := bufio.NewReader(pipe)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			writer.Write(line)
+			service.publishOutput(string(line))
+			if isStderr {
+				service.rememberStderr(string(line))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// waitOutputCaptured gives a chance to read rest of output of finished process,
+// pipes might be kept open by process children so wait is limited
+func (service *Service) waitOutputCaptured() {
+	service.mutex.RLock()
+	outputCapture := service.outputCapture
+	service.mutex.RUnlock()
+	if outputCapture == nil {
+		return
+	}
+	captured := make(chan interface{})
+	go func() {
+		outputCapture.Wait()
+		close(captured)
+	}()
+	select {
+	case <-captured:
+	case <-time.After(outputCaptureTimeout):
+	}
+}
+
 func (service *Service) cleanFiles() {
 	service.mutex.RLock()
 	if service.PidFile != "" {
 		os.Remove(service.PidFile)
+		os.Remove(service.controlSocketName())
 	}
-	if service.SockFile != "" {
+	// socket owned by supervisor keeps clients waiting for restarted process
+	keepSocket := service.listener != nil && service.Status == ServiceStatus_RESPAWNING
+	if service.SockFile != "" && service.listener == nil {
 		os.Remove(service.SockFile)
 	}
 	service.mutex.RUnlock()
+	if !keepSocket {
+		service.closeListener()
+	}
+	service.closeNotifySocket()
+	service.removeCgroup()
 }
 
 func (service *Service) stopProcess() {
-	timeout := time.After(time.Duration(service.ShutdownTimeout) * time.Second)
+	service.mutex.RLock()
+	shutdownTimeout := service.ShutdownTimeout
+	drainTimeout := time.Duration(service.DrainTimeout) * time.Second
+	serviceStatus := service.Status
+	service.mutex.RUnlock()
+	if drainTimeout > 0 && serviceStatus == ServiceStatus_RUNNING {
+		drained, err := service.drain(drainTimeout)
+		if err != nil {
+			service.logger().Warningf("cant drain service %s@%s: %v", service.ServiceName, service.InstanceName, err)
+		} else if drained {
+			return
+		} else {
+			service.logger().Warningf("service %s@%s not drained within %v, terminating it",
+				service.ServiceName, service.InstanceName, drainTimeout)
+		}
+	}
+	timeout := time.After(time.Duration(shutdownTimeout) * time.Second)
 	signalToSend := syscall.SIGTERM
 	for {
-		service.mutex.RLock()
+		// drained process might exit meanwhile, so status is changed together with check
+		service.mutex.Lock()
 		process := service.process
-		service.mutex.RUnlock()
+		if process != nil {
+			service.setStatus(ServiceStatus_SHUTDOWN)
+		}
+		service.mutex.Unlock()
 		if process == nil {
-			log.Infof("service %s@%s is not running", service.ServiceName, service.InstanceName)
+			service.logger().Infof("service %s@%s is not running", service.ServiceName, service.InstanceName)
 			break
 		}
 		if signalToSend == syscall.SIGTERM {
-			log.Infof("terminating service %s@%s (pid=%v)", service.ServiceName, service.InstanceName, process.Pid)
+			service.logger().WithField("pid", process.Pid).Infof("terminating service %s@%s (pid=%v)", service.ServiceName, service.InstanceName, process.Pid)
 		} else {
-			log.Warningf("killing service %s@%s (pid=%v) after terminate attempt not finished within %v seconds",
-				service.ServiceName, service.InstanceName, process.Pid, service.ShutdownTimeout,
+			service.logger().WithField("pid", process.Pid).Warningf("killing service %s@%s (pid=%v) after terminate attempt not finished within %v seconds",
+				service.ServiceName, service.InstanceName, process.Pid, shutdownTimeout,
 			)
 		}
-		service.mutex.Lock()
-		service.Status = ServiceStatus_SHUTDOWN
-		service.mutex.Unlock()
 		process.Signal(signalToSend)
 		select {
 		case <-service.shutdownComplete:
 			service.mutex.Lock()
-			service.Status = ServiceStatus_STOPPED
 			service.process = nil
+			service.setStatus(ServiceStatus_STOPPED)
 			service.mutex.Unlock()
 			return
 		case <-timeout:
@@ -283,13 +629,27 @@ func (service *Service) stopProcess() {
 }
 
 func (service *Service) prepareArguments() (string, []string) {
-	arguments := []string{
-		service.Executable,
-		"-P", service.PidFile,
-		"-L", service.LogFile,
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	arguments := []string{service.Executable}
+	if service.Arguments != nil {
+		for _, argument := range service.Arguments {
+			arguments = append(arguments, service.expandVariables(argument))
+		}
+	} else {
+		arguments = append(arguments, "-P", service.PidFile, "-L", "stdout")
+		if service.InstanceName != "" {
+			arguments = append(arguments, "-N", service.InstanceName)
+		}
+		if service.Replica > 1 {
+			arguments = append(arguments, "-R", strconv.Itoa(service.Replica))
+		}
+	}
+	for _, argument := range service.ExtraArguments {
+		arguments = append(arguments, service.expandVariables(argument))
 	}
-	if service.InstanceName != "" {
-		arguments = append(arguments, "-N", service.InstanceName)
+	if service.Umask != "" {
+		return umaskWrapper(service.Umask, service.Executable, arguments)
 	}
 	return service.Executable, arguments
 }
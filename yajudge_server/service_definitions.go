@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/exp/slices"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// masterServiceNames are built-in services defined for each instance by default
+var masterServiceNames = []string{"users", "content", "courses", "sessions", "submissions", "deadlines", "review", "progress"}
+
+// ServiceConf describes service managed by supervisor. Built-in master services
+// have default definitions which fields might be overridden in supervisor.yaml.
+type ServiceConf struct {
+	Executable string `yaml:"executable" json:"executable"`
+	// standard yajudge service arguments are used if not set;
+	// ${YAJUDGE_INSTANCE}, ${YAJUDGE_PID_FILE} and so on are expanded
+	Args []string `yaml:"args" json:"args"`
+	// appended to standard or configured arguments, for example tuning flags
+	ExtraArgs []string          `yaml:"extra_args" json:"extra_args"`
+	Env       map[string]string `yaml:"env" json:"env"`
+	// variables which values are read from files on each start, to keep secrets out of configuration
+	EnvFiles   map[string]string `yaml:"env_files" json:"env_files"`
+	WorkingDir string            `yaml:"working_dir" json:"working_dir"`
+	// octal file mode creation mask like "027"
+	Umask string `yaml:"umask" json:"umask"`
+	// user and group are applied only if supervisor runs as root,
+	// primary group of user is used if group is not set
+	User  string `yaml:"user" json:"user"`
+	Group string `yaml:"group" json:"group"`
+	// service serves gRPC on <sock dir>/<instance>/<service>.sock
+	Socket bool `yaml:"socket" json:"socket"`
+	// service accepts socket created by supervisor as descriptor 3 (LISTEN_FDS),
+	// used if socket_activation is enabled in server.yaml
+	SocketActivation bool `yaml:"socket_activation" json:"socket_activation"`
+	// service sends READY=1 to $NOTIFY_SOCKET when ready instead of readiness probing
+	Notify bool `yaml:"notify" json:"notify"`
+	// service is killed and restarted if it does not send WATCHDOG=1 within this interval
+	WatchdogSec int `yaml:"watchdog_sec" json:"watchdog_sec"`
+	// these fields are merged into autostart_services, dependencies and restart_policies
+	Autostart     bool            `yaml:"autostart" json:"autostart"`
+	Dependencies  []string        `yaml:"dependencies" json:"dependencies"`
+	RestartPolicy json.RawMessage `yaml:"restart_policy" json:"restart_policy"`
+}
+
+func isBuiltinService(serviceName string) bool {
+	return slices.Contains(masterServiceNames, serviceName) || isGraderService(serviceName)
+}
+
+// parseServiceDefinitions validates services declared in supervisor.yaml and merges
+// their autostart, dependencies and restart policy into instance configuration
+func (config *SupervisorConfig) parseServiceDefinitions() error {
+	serviceNames := make([]string, 0, len(config.Services))
+	for serviceName := range config.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		if isGraderService(serviceName) && serviceName != graderServiceName {
+			return fmt.Errorf("service name %s is reserved, use %s to configure all grader replicas",
+				serviceName, graderServiceName)
+		}
+		if serviceName == "webserver" {
+			return fmt.Errorf("webserver is configured in server.yaml")
+		}
+		definition := ServiceConf{}
+		if err := json.Unmarshal(config.Services[serviceName], &definition); err != nil {
+			return fmt.Errorf("wrong definition of service %s: %v", serviceName, err)
+		}
+		if err := definition.validate(); err != nil {
+			return fmt.Errorf("wrong definition of service %s: %v", serviceName, err)
+		}
+		if serviceName == graderServiceName {
+			// grader is started by autostart_grader and waits for all master services
+			if err := definition.validateProcessOnly(); err != nil {
+				return fmt.Errorf("wrong definition of grader: %v", err)
+			}
+		} else if definition.Executable == "" && !slices.Contains(masterServiceNames, serviceName) {
+			return fmt.Errorf("no executable set for service %s", serviceName)
+		}
+		if definition.Autostart && !slices.Contains(config.AutostartServices, serviceName) {
+			config.AutostartServices = append(config.AutostartServices, serviceName)
+		}
+		if _, overridden := config.Dependencies[serviceName]; !overridden && definition.Dependencies != nil {
+			config.Dependencies[serviceName] = definition.Dependencies
+		}
+		if _, overridden := config.RestartPolicies[serviceName]; !overridden && definition.RestartPolicy != nil {
+			if err := validateRestartPolicyOverride(definition.RestartPolicy); err != nil {
+				return fmt.Errorf("wrong restart policy of service %s: %v", serviceName, err)
+			}
+			if config.RestartPolicies == nil {
+				config.RestartPolicies = make(map[string]json.RawMessage)
+			}
+			config.RestartPolicies[serviceName] = definition.RestartPolicy
+		}
+	}
+	return nil
+}
+
+// serviceDefinitions returns built-in master services definitions overridden
+// by instance configuration together with custom services
+func serviceDefinitions(globalConfig *ServerConfig, config *SupervisorConfig) map[string]ServiceConf {
+	result := make(map[string]ServiceConf, len(masterServiceNames)+len(config.Services))
+	for _, serviceName := range masterServiceNames {
+		result[serviceName] = ServiceConf{
+			Executable:       globalConfig.ServiceExecutables[serviceName],
+			Socket:           true,
+			SocketActivation: true,
+		}
+	}
+	for serviceName, override := range config.Services {
+		if serviceName == graderServiceName {
+			continue
+		}
+		definition := result[serviceName]
+		// override was validated while loading configuration
+		json.Unmarshal(override, &definition)
+		definition.resolveExecutable(globalConfig.YajudgeRootDir)
+		result[serviceName] = definition
+	}
+	return result
+}
+
+// graderDefinition returns definition of grader process shared by all replicas
+func graderDefinition(globalConfig *ServerConfig, config *SupervisorConfig) ServiceConf {
+	definition := ServiceConf{Executable: globalConfig.ServiceExecutables[graderServiceName]}
+	if override, overridden := config.Services[graderServiceName]; overridden {
+		json.Unmarshal(override, &definition)
+		definition.resolveExecutable(globalConfig.YajudgeRootDir)
+	}
+	return definition
+}
+
+// webServerDefinition returns definition of webserver process from server.yaml
+func webServerDefinition(globalConfig *ServerConfig) ServiceConf {
+	definition := globalConfig.WebServer
+	if definition.Executable == "" {
+		definition.Executable = globalConfig.ServiceExecutables["webserver"]
+	}
+	definition.resolveExecutable(globalConfig.YajudgeRootDir)
+	return definition
+}
+
+func (definition *ServiceConf) resolveExecutable(yajudgeRootDir string) {
+	if !path.IsAbs(definition.Executable) {
+		definition.Executable = path.Join(yajudgeRootDir, definition.Executable)
+	}
+}
+
+func (definition *ServiceConf) validate() error {
+	if definition.Umask != "" {
+		if _, err := strconv.ParseUint(definition.Umask, 8, 32); err != nil {
+			return fmt.Errorf("umask %s is not octal number", definition.Umask)
+		}
+	}
+	if definition.SocketActivation && !definition.Socket {
+		return fmt.Errorf("socket_activation requires socket")
+	}
+	for name := range definition.EnvFiles {
+		if _, defined := definition.Env[name]; defined {
+			return fmt.Errorf("variable %s is set by both env and env_files", name)
+		}
+	}
+	return nil
+}
+
+// validateProcessOnly checks that definition of service managed in a special
+// way (grader and webserver) does not contain fields not applicable to them
+func (definition *ServiceConf) validateProcessOnly() error {
+	if definition.Socket || definition.SocketActivation || definition.Notify {
+		return fmt.Errorf("socket, socket_activation and notify are not supported")
+	}
+	if definition.Autostart || definition.Dependencies != nil {
+		return fmt.Errorf("autostart and dependencies are not supported")
+	}
+	return nil
+}
+
+// SetDefinition changes the way service process is started, takes effect on next start
+func (service *Service) SetDefinition(definition ServiceConf, sockFile string) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.Executable = definition.Executable
+	service.SockFile = sockFile
+	service.Arguments = definition.Args
+	service.Environment = definition.Env
+	service.WorkingDir = definition.WorkingDir
+	service.ExtraArguments = definition.ExtraArgs
+	service.EnvironmentFiles = definition.EnvFiles
+	service.Umask = definition.Umask
+	service.User = definition.User
+	service.Group = definition.Group
+	service.NotifyReady = definition.Notify
+	service.socketActivationSupported = definition.SocketActivation
+	service.WatchdogSec = definition.WatchdogSec
+}
+
+// variables are passed to service environment and expanded in its arguments
+func (service *Service) variables() map[string]string {
+	return map[string]string{
+		"YAJUDGE_INSTANCE":       service.InstanceName,
+		"YAJUDGE_SERVICE":        service.ServiceName,
+		"YAJUDGE_PID_FILE":       service.PidFile,
+		"YAJUDGE_LOG_FILE":       service.LogFile,
+		"YAJUDGE_SOCK_FILE":      service.SockFile,
+		"YAJUDGE_CONTROL_SOCKET": service.controlSocketName(),
+	}
+}
+
+func (service *Service) expandVariables(value string) string {
+	variables := service.variables()
+	return os.Expand(value, func(name string) string {
+		if variable, defined := variables[name]; defined {
+			return variable
+		}
+		return os.Getenv(name)
+	})
+}
+
+// processEnvironment returns supervisor environment extended by service variables
+func (service *Service) processEnvironment() []string {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	result := os.Environ()
+	for name, value := range service.variables() {
+		result = append(result, name+"="+value)
+	}
+	names := make([]string, 0, len(service.Environment))
+	for name := range service.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, name+"="+service.expandVariables(service.Environment[name]))
+	}
+	return result
+}
+
+// secretEnvironment reads values of variables from their files,
+// service can not be started if any of files is not readable
+func (service *Service) secretEnvironment() ([]string, error) {
+	service.mutex.RLock()
+	files := service.EnvironmentFiles
+	service.mutex.RUnlock()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		content, err := os.ReadFile(files[name])
+		if err != nil {
+			return nil, fmt.Errorf("cant read value of %s: %v", name, err)
+		}
+		result = append(result, name+"="+strings.TrimRight(string(content), "\r\n"))
+	}
+	return result, nil
+}
+
+// umaskWrapper makes shell set file mode creation mask before exec of
+// service executable as there is no way to set it for child process only
+func umaskWrapper(umask string, executable string, arguments []string) (string, []string) {
+	wrappedArguments := []string{"/bin/sh", "-c", "umask " + umask + `; exec "$0" "$@"`, executable}
+	wrappedArguments = append(wrappedArguments, arguments[1:]...)
+	return wrappedArguments[0], wrappedArguments
+}
+
+// credential returns process credential to run service as configured user and group
+func (service *Service) credential() (*syscall.Credential, error) {
+	service.mutex.RLock()
+	userName := service.User
+	groupName := service.Group
+	service.mutex.RUnlock()
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		service.logger().Warningf("user and group of service %s@%s are ignored as supervisor is not running as root",
+			service.ServiceName, service.InstanceName)
+		return nil, nil
+	}
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if userName != "" {
+		account, err := user.Lookup(userName)
+		if err != nil {
+			return nil, fmt.Errorf("cant find user %s: %v", userName, err)
+		}
+		uid, _ := strconv.Atoi(account.Uid)
+		gid, _ := strconv.Atoi(account.Gid)
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+		groupIds, _ := account.GroupIds()
+		for _, groupId := range groupIds {
+			if group, err := strconv.Atoi(groupId); err == nil {
+				credential.Groups = append(credential.Groups, uint32(group))
+			}
+		}
+	}
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("cant find group %s: %v", groupName, err)
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		credential.Gid = uint32(gid)
+	}
+	return credential, nil
+}
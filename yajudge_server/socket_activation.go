@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// socket activated process is considered ready for rolling restart
+// if it keeps running this long after socket answers
+const activationSettleTime = time.Second
+
+// activationWrapper makes shell exec service executable so that LISTEN_PID
+// matches actual process pid which is not known before fork
+var activationWrapper = []string{"/bin/sh", "-c", `export LISTEN_PID=$$; exec "$0" "$@"`}
+
+// SetSocketActivation enables passing service socket created by supervisor
+// to service process if service definition declares its support. Takes effect
+// on next process start, but socket already created is passed to processes
+// until service stopped.
+func (service *Service) SetSocketActivation(enabled bool) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.SocketActivation = enabled && service.socketActivationSupported && service.SockFile != ""
+}
+
+// socketActivated reports if running process uses socket owned by supervisor
+func (service *Service) socketActivated() bool {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	return service.listener != nil
+}
+
+// listenerFile returns duplicate of service listening socket descriptor
+// to be inherited by process, socket is created on first call and kept
+// until service stopped so clients are queued while process restarts
+func (service *Service) listenerFile() (*os.File, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.listener == nil {
+		os.Remove(service.SockFile)
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: service.SockFile, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("cant listen %s: %v", service.SockFile, err)
+		}
+		os.Chmod(service.SockFile, 0o660)
+		service.listener = listener
+	}
+	return service.listener.File()
+}
+
+// closeListener closes service socket and removes its file
+func (service *Service) closeListener() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.listener == nil {
+		return
+	}
+	if err := service.listener.Close(); err != nil {
+		service.logger().Warningf("cant close socket of %s@%s: %v", service.ServiceName, service.InstanceName, err)
+	}
+	service.listener = nil
+}
+
+// passListener makes process inherit listening socket in systemd style,
+// it follows standard descriptors so gets number 3 required by sd_listen_fds(3)
+func passListener(executable string, arguments []string, attributes *os.ProcAttr, socket *os.File, name string) (string, []string) {
+	attributes.Files = append(attributes.Files, socket)
+	attributes.Env = append(attributes.Env, "LISTEN_FDS=1", "LISTEN_FDNAMES="+name)
+	wrappedArguments := append(append([]string{}, activationWrapper...), executable)
+	wrappedArguments = append(wrappedArguments, arguments[1:]...)
+	return activationWrapper[0], wrappedArguments
+}
+
+// waitActivatedReady blocks until replacement process of socket activated
+// service answers on shared socket and keeps running for a while
+func waitActivatedReady(sockFile string, pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastError error
+	var answeredAt time.Time
+	for {
+		if processFinished(pid) {
+			return fmt.Errorf("process exited")
+		}
+		if _, lastError = probeSocket(sockFile, readinessProbeInterval); lastError != nil {
+			answeredAt = time.Time{}
+		} else if answeredAt.IsZero() {
+			answeredAt = time.Now()
+		} else if time.Since(answeredAt) >= activationSettleTime {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if lastError != nil {
+				return fmt.Errorf("not ready within %v: %v", timeout, lastError)
+			}
+			return fmt.Errorf("not ready within %v", timeout)
+		}
+		time.Sleep(readinessProbeInterval)
+	}
+}
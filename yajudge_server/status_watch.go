@@ -0,0 +1,129 @@
+package main
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const statusWatcherBufferSize = 1000
+
+// statusWatcher is closed if subscriber does not keep up with changes
+type statusWatcher chan *ServiceStatusEvent
+
+// SetStatusListener sets function called on each service status change
+func (service *Service) SetStatusListener(listener StatusFunc) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.statusListener = listener
+}
+
+// setStatus changes service status and notifies listener, must be called
+// with mutex locked after other fields of new state are set
+func (service *Service) setStatus(newStatus ServiceStatus) {
+	if service.Status == newStatus {
+		return
+	}
+	service.Status = newStatus
+	service.publishStatus()
+}
+
+// publishStatus must be called with mutex locked
+func (service *Service) publishStatus() {
+	if service.statusListener != nil {
+		service.statusListener(service.InstanceName, service.statusSnapshot())
+	}
+}
+
+func (service *SupervisorService) subscribeStatus() statusWatcher {
+	watcher := make(statusWatcher, statusWatcherBufferSize)
+	service.statusWatchersMutex.Lock()
+	defer service.statusWatchersMutex.Unlock()
+	if service.statusWatchers == nil {
+		service.statusWatchers = make(map[statusWatcher]bool)
+	}
+	service.statusWatchers[watcher] = true
+	return watcher
+}
+
+func (service *SupervisorService) unsubscribeStatus(watcher statusWatcher) {
+	service.statusWatchersMutex.Lock()
+	defer service.statusWatchersMutex.Unlock()
+	delete(service.statusWatchers, watcher)
+}
+
+// publishStatus is called by services holding their mutex, so it must not block
+func (service *SupervisorService) publishStatus(instanceName string, serviceStatus *ServiceStatusResponse) {
+	if instanceName == "" {
+		instanceName = "webserver"
+	}
+	event := &ServiceStatusEvent{
+		InstanceName: instanceName,
+		Status:       serviceStatus,
+		Time:         time.Now().Unix(),
+	}
+	service.statusWatchersMutex.Lock()
+	defer service.statusWatchersMutex.Unlock()
+	for watcher := range service.statusWatchers {
+		select {
+		case watcher <- event:
+		default:
+			// slow watcher must not block services, it is dropped
+			// to resubscribe rather than silently miss changes
+			delete(service.statusWatchers, watcher)
+			close(watcher)
+		}
+	}
+}
+
+// WatchStatus sends current statuses of services followed by their changes,
+// all instances and webserver are watched if no instance name specified
+func (service *SupervisorService) WatchStatus(request *WatchStatusRequest, stream Supervisor_WatchStatusServer) error {
+	instanceName := request.InstanceName
+	if instanceName == "web" || instanceName == "grpcwebserver" {
+		instanceName = "webserver"
+	}
+	if instanceName != "" && instanceName != "webserver" {
+		if _, instanceFound := service.getInstance(instanceName); !instanceFound {
+			return status.Errorf(codes.NotFound, "instance %s not found", instanceName)
+		}
+	}
+	// subscribe before sending current statuses to not miss changes meanwhile
+	watcher := service.subscribeStatus()
+	defer service.unsubscribeStatus(watcher)
+	now := time.Now().Unix()
+	if instanceName == "" || instanceName == "webserver" {
+		event := &ServiceStatusEvent{InstanceName: "webserver", Status: service.WebServer.GetStatus(), Time: now}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	for _, instance := range service.instancesList() {
+		if instanceName != "" && instance.Name != instanceName {
+			continue
+		}
+		for _, serviceStatus := range instance.GetServiceStatuses() {
+			event := &ServiceStatusEvent{InstanceName: instance.Name, Status: serviceStatus, Time: now}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+	done := stream.Context().Done()
+	for {
+		select {
+		case event, subscribed := <-watcher:
+			if !subscribed {
+				return status.Errorf(codes.ResourceExhausted, "status changes are lost as watcher is too slow, resubscribe to get actual statuses")
+			}
+			if instanceName != "" && event.InstanceName != instanceName {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
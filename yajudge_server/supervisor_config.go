@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/ghodss/yaml"
 	"os"
@@ -13,12 +14,33 @@ type RestartPolicyConf struct {
 	MaxTries          int `yaml:"max_tries" json:"max_tries"`
 	RestartIntervalMs int `yaml:"restart_interval_ms" json:"restart_interval_ms"`
 	ResetAfterSec     int `yaml:"reset_after_sec" json:"reset_after_sec"`
+	// restart interval is multiplied each attempt up to max_interval_ms
+	BackoffMultiplier float64 `yaml:"backoff_multiplier" json:"backoff_multiplier"`
+	MaxIntervalMs     int     `yaml:"max_interval_ms" json:"max_interval_ms"`
+	// random fraction of interval added or subtracted to not restart all services at once
+	Jitter float64 `yaml:"jitter" json:"jitter"`
+	// keep restarting every max_interval_ms after max_tries attempts instead of giving up
+	NeverGiveUp bool `yaml:"never_give_up" json:"never_give_up"`
 }
 
-type StartIntervalsConf struct {
-	Grader        int `yaml:"grader" json:"grader"`
-	GrpcWebServer int `yaml:"grpcwebserver" json:"grpcwebserver"`
-	Microservice  int `yaml:"microservice" json:"microservice"`
+type HealthCheckConf struct {
+	IntervalMs       int `yaml:"interval_ms" json:"interval_ms"`
+	TimeoutMs        int `yaml:"timeout_ms" json:"timeout_ms"`
+	FailureThreshold int `yaml:"failure_threshold" json:"failure_threshold"`
+	StartPeriodSec   int `yaml:"start_period_sec" json:"start_period_sec"`
+}
+
+type LogRotationConf struct {
+	MaxSizeMb   int `yaml:"max_size_mb" json:"max_size_mb"`
+	MaxAgeHours int `yaml:"max_age_hours" json:"max_age_hours"`
+	RetainCount int `yaml:"retain_count" json:"retain_count"`
+}
+
+// defaultServiceDependencies lists master services that must be serving
+// before the key service starts. Grader dependencies are not listed here
+// because grader always waits for all enabled master services of instance.
+var defaultServiceDependencies = map[string][]string{
+	"submissions": {"sessions"},
 }
 
 type SupervisorConfig struct {
@@ -26,25 +48,55 @@ type SupervisorConfig struct {
 	InstanceName            string
 	AutostartServices       []string
 	AutostartGrader         bool `yaml:"autostart_grader" json:"autostart_grader"`
+	GraderReplicas          int  `yaml:"grader_replicas" json:"grader_replicas"`
 	GraderBinPath           string
 	ServicesBinPaths        map[string]string
-	AutostartServicesString string `yaml:"autostart_services" json:"autostart_services"`
+	AutostartServicesString string              `yaml:"autostart_services" json:"autostart_services"`
+	Dependencies            map[string][]string `yaml:"dependencies" json:"dependencies"`
+	// per service limits overriding ones from server.yaml
+	ResourceLimits map[string]ResourceLimitsConf `yaml:"resource_limits" json:"resource_limits"`
+	// per service restart policy fields overriding ones from server.yaml
+	RestartPolicies map[string]json.RawMessage `yaml:"restart_policies" json:"restart_policies"`
+	// custom services and overrides of built-in ones, see ServiceConf
+	Services map[string]json.RawMessage `yaml:"services" json:"services"`
+	// scheduled restarts, stops, starts and maintenance windows
+	Schedules []ScheduleConf `yaml:"schedules" json:"schedules"`
 }
 
 type ServerConfig struct {
 	FileName               string
 	LogFileName            string
 	PidFileName            string
-	GRPCSocketFileName     string             `yaml:"grpc_socket_file_name" json:"grpc_socket_file_name"`
-	AutostartGrpcWebServer bool               `yaml:"autostart_grpcwebserver" json:"autostart_grpcwebserver"`
-	ChainStartIntervals    StartIntervalsConf `yaml:"chain_start_intervals" json:"chain_start_intervals"`
-	RestartPolicy          RestartPolicyConf  `yaml:"restart_policy" json:"restart_policy"`
-	ShutdownTimeout        int                `yaml:"shutdown_timeout_sec" json:"shutdown_timeout_sec"`
-	Instances              []*SupervisorConfig
-	ServiceExecutables     map[string]string
-	LogFileDir             string
-	PidFileDir             string
-	SockFileDir            string
+	LogFormat              string              `yaml:"log_format" json:"log_format"`
+	LogLevel               string              `yaml:"log_level" json:"log_level"`
+	GRPCSocketFileName     string              `yaml:"grpc_socket_file_name" json:"grpc_socket_file_name"`
+	AutostartGrpcWebServer bool                `yaml:"autostart_grpcwebserver" json:"autostart_grpcwebserver"`
+	StartTimeout           int                 `yaml:"start_timeout_sec" json:"start_timeout_sec"`
+	RestartPolicy          RestartPolicyConf   `yaml:"restart_policy" json:"restart_policy"`
+	HealthCheck            HealthCheckConf     `yaml:"health_check" json:"health_check"`
+	LogRotation            LogRotationConf     `yaml:"log_rotation" json:"log_rotation"`
+	ShutdownTimeout        int                 `yaml:"shutdown_timeout_sec" json:"shutdown_timeout_sec"`
+	DrainTimeout           int                 `yaml:"drain_timeout_sec" json:"drain_timeout_sec"`
+	CgroupRoot             string              `yaml:"cgroup_root" json:"cgroup_root"`
+	SocketActivation       bool                `yaml:"socket_activation" json:"socket_activation"`
+	ProcessAdoption        ProcessAdoptionConf `yaml:"process_adoption" json:"process_adoption"`
+	Metrics                MetricsConf         `yaml:"metrics" json:"metrics"`
+	EventHistory           EventHistoryConf    `yaml:"event_history" json:"event_history"`
+	// records of start, stop and other mutating calls, log/audit.log by default
+	AuditLogFile string `yaml:"audit_log_file" json:"audit_log_file"`
+	// rules allowing callers of supervisor socket, everyone is allowed if empty
+	AccessPolicy []AccessRuleConf `yaml:"access_policy" json:"access_policy"`
+	RemoteAPI    RemoteAPIConf    `yaml:"remote_api" json:"remote_api"`
+	// webserver process arguments, environment and credentials
+	WebServer ServiceConf `yaml:"webserver" json:"webserver"`
+	// default per service limits, "webserver" key is used by webserver
+	ResourceLimits     map[string]ResourceLimitsConf `yaml:"resource_limits" json:"resource_limits"`
+	Instances          []*SupervisorConfig
+	ServiceExecutables map[string]string
+	YajudgeRootDir     string
+	LogFileDir         string
+	PidFileDir         string
+	SockFileDir        string
 }
 
 func (config *ServerConfig) ResolvePaths(yajudgeRootDir string) error {
@@ -52,7 +104,6 @@ func (config *ServerConfig) ResolvePaths(yajudgeRootDir string) error {
 	masterDevelBinDir := path.Join(yajudgeRootDir, "yajudge_master_services", "bin")
 	graderDevelBinDir := path.Join(yajudgeRootDir, "yajudge_grader", "bin")
 	webserverDevelBinDir := path.Join(yajudgeRootDir, "yajudge_grpcwebserver")
-	masterServices := []string{"users", "content", "courses", "sessions", "submissions", "deadlines", "review", "progress"}
 	var masterBinDir string
 	var graderBinDir string
 	var webserverBinDir string
@@ -80,7 +131,7 @@ func (config *ServerConfig) ResolvePaths(yajudgeRootDir string) error {
 	config.ServiceExecutables = make(map[string]string)
 	config.ServiceExecutables["grader"] = graderExe
 	config.ServiceExecutables["webserver"] = webserverExe
-	for _, service := range masterServices {
+	for _, service := range masterServiceNames {
 		serviceExe := path.Join(masterBinDir, "yajudge-service-"+service)
 		if runtime.GOOS == "windows" {
 			serviceExe += ".exe"
@@ -90,8 +141,15 @@ func (config *ServerConfig) ResolvePaths(yajudgeRootDir string) error {
 		}
 		config.ServiceExecutables[service] = serviceExe
 	}
+	config.YajudgeRootDir = yajudgeRootDir
 	config.LogFileDir = path.Join(yajudgeRootDir, "log")
 	config.PidFileDir = path.Join(yajudgeRootDir, "pid")
+	if config.ProcessAdoption.StateFile == "" {
+		config.ProcessAdoption.StateFile = path.Join(config.PidFileDir, "supervisor.state")
+	}
+	if config.AuditLogFile == "" {
+		config.AuditLogFile = path.Join(config.LogFileDir, "audit.log")
+	}
 	return nil
 }
 
@@ -110,6 +168,31 @@ func LoadSupervisorConfig(fileName string) (*SupervisorConfig, error) {
 	if supervisorConfig.AutostartServicesString != "" {
 		supervisorConfig.AutostartServices = strings.Split(supervisorConfig.AutostartServicesString, " ")
 	}
+	if supervisorConfig.GraderReplicas < 1 {
+		supervisorConfig.GraderReplicas = 1
+	}
+	if supervisorConfig.Dependencies == nil {
+		supervisorConfig.Dependencies = make(map[string][]string)
+	}
+	for serviceName, override := range supervisorConfig.RestartPolicies {
+		if err := validateRestartPolicyOverride(override); err != nil {
+			return nil, fmt.Errorf("wrong restart policy of service %s in %s: %v", serviceName, fileName, err)
+		}
+	}
+	if err := validateResourceLimits(supervisorConfig.ResourceLimits); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, fileName)
+	}
+	if err := supervisorConfig.parseServiceDefinitions(); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, fileName)
+	}
+	if err := supervisorConfig.parseSchedules(); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, fileName)
+	}
+	for serviceName, dependencies := range defaultServiceDependencies {
+		if _, overridden := supervisorConfig.Dependencies[serviceName]; !overridden {
+			supervisorConfig.Dependencies[serviceName] = dependencies
+		}
+	}
 	return supervisorConfig, nil
 }
 
@@ -125,6 +208,24 @@ func LoadServerConfig(fileName string) (*ServerConfig, error) {
 	if err := yaml.Unmarshal(yamlContent, serverConfig); err != nil {
 		return nil, fmt.Errorf("cant parse %s: %v", fileName, err)
 	}
+	if err := serverConfig.validateLogging(); err != nil {
+		return nil, fmt.Errorf("wrong logging options in %s: %v", fileName, err)
+	}
+	if err := serverConfig.RestartPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("wrong restart_policy in %s: %v", fileName, err)
+	}
+	if err := serverConfig.validateAccessPolicy(); err != nil {
+		return nil, fmt.Errorf("wrong access_policy in %s: %v", fileName, err)
+	}
+	if err := serverConfig.WebServer.validate(); err != nil {
+		return nil, fmt.Errorf("wrong webserver in %s: %v", fileName, err)
+	}
+	if err := serverConfig.WebServer.validateProcessOnly(); err != nil {
+		return nil, fmt.Errorf("wrong webserver in %s: %v", fileName, err)
+	}
+	if err := validateResourceLimits(serverConfig.ResourceLimits); err != nil {
+		return nil, fmt.Errorf("%v in %s", err, fileName)
+	}
 	configDir := path.Dir(fileName)
 	serverConfig.Instances, err = LoadSupervisorConfigsFromSubdirectories(configDir)
 	if err != nil {
@@ -136,6 +237,53 @@ func LoadServerConfig(fileName string) (*ServerConfig, error) {
 		serverConfig.GRPCSocketFileName = path.Join(sockDir, "supervisor.sock")
 	}
 	serverConfig.SockFileDir = path.Dir(serverConfig.GRPCSocketFileName)
+	if serverConfig.StartTimeout == 0 {
+		serverConfig.StartTimeout = 30
+	}
+	if serverConfig.RestartPolicy.BackoffMultiplier == 0 {
+		serverConfig.RestartPolicy.BackoffMultiplier = 2
+	}
+	if serverConfig.RestartPolicy.MaxIntervalMs == 0 {
+		serverConfig.RestartPolicy.MaxIntervalMs = 30000
+	}
+	if serverConfig.DrainTimeout == 0 {
+		serverConfig.DrainTimeout = 300
+	}
+	if serverConfig.HealthCheck.IntervalMs == 0 {
+		serverConfig.HealthCheck.IntervalMs = 5000
+	}
+	if serverConfig.HealthCheck.TimeoutMs == 0 {
+		serverConfig.HealthCheck.TimeoutMs = 1000
+	}
+	if serverConfig.HealthCheck.FailureThreshold == 0 {
+		serverConfig.HealthCheck.FailureThreshold = 3
+	}
+	if serverConfig.LogRotation.MaxSizeMb == 0 {
+		serverConfig.LogRotation.MaxSizeMb = 50
+	}
+	if serverConfig.LogRotation.RetainCount == 0 {
+		serverConfig.LogRotation.RetainCount = 10
+	}
+	if serverConfig.HealthCheck.StartPeriodSec == 0 {
+		serverConfig.HealthCheck.StartPeriodSec = serverConfig.StartTimeout
+	}
+	if serverConfig.EventHistory.Size == 0 {
+		serverConfig.EventHistory.Size = 100
+	}
+	if serverConfig.EventHistory.StderrLines == 0 {
+		serverConfig.EventHistory.StderrLines = 20
+	}
+	if serverConfig.Metrics.Path == "" {
+		serverConfig.Metrics.Path = "/metrics"
+	}
+	if serverConfig.CgroupRoot == "" {
+		// services run without limits if cgroup v2 is not available
+		if cgroupRoot, err := delegatedCgroupRoot(); err == nil {
+			serverConfig.CgroupRoot = cgroupRoot
+		}
+	} else if _, err := os.Stat(path.Join(serverConfig.CgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup_root %s in %s is not cgroup v2 directory", serverConfig.CgroupRoot, fileName)
+	}
 	return serverConfig, nil
 }
 
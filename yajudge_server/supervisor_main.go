@@ -9,6 +9,7 @@ import (
 )
 
 func main() {
+	takeSystemdNotifySocket()
 	configFileName := flag.String("C", "", "config file name")
 	logFileName := flag.String("L", "", "log file name")
 	pidFileName := flag.String("P", "", "PID file name")
@@ -47,13 +48,13 @@ func main() {
 		serverConfig.GRPCSocketFileName = path.Join(yajudgeRootDir, "sock", "supervisor.sock")
 	}
 	if serverConfig.LogFileName != "stdout" {
-		logFile, err := os.OpenFile(serverConfig.LogFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o660)
+		logFile, err := OpenRotatingFile(serverConfig.LogFileName, serverConfig.LogRotation)
 		if err != nil {
-			log.Fatalf("cant create or open log file %s: %v", serverConfig.LogFileName, err)
+			log.Fatalf("%v", err)
 		}
-		os.Chmod(serverConfig.LogFileName, 0o660)
 		log.SetOutput(logFile)
 	}
+	serverConfig.configureLogger()
 	service := NewSupervisorService(serverConfig)
 	service.Main()
 }
@@ -11,6 +11,8 @@ import (
 	"os/signal"
 	"path"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -21,8 +23,20 @@ type SupervisorService struct {
 	SupervisorServer
 	Config     *ServerConfig
 	GRPCServer *grpc.Server
-	Instances  map[string]*Instance
-	WebServer  *Service
+	// serves remote API over TCP if configured
+	RemoteGRPCServer *grpc.Server
+	Instances        map[string]*Instance
+	WebServer        *Service
+
+	// guards Config and Instances which are replaced on reload
+	mutex       sync.RWMutex
+	reloadMutex sync.Mutex
+	rpcCounters rpcCounters
+
+	statusWatchers      map[statusWatcher]bool
+	statusWatchersMutex sync.Mutex
+
+	autostartDone atomic.Bool
 }
 
 func NewSupervisorService(config *ServerConfig) *SupervisorService {
@@ -45,16 +59,47 @@ func NewSupervisorService(config *ServerConfig) *SupervisorService {
 		"",
 		initialWebserverStatus,
 		config.RestartPolicy,
+		config.HealthCheck,
+		config.LogRotation,
 		config.ShutdownTimeout,
 		result.NotifyOnServiceExit,
 	)
+	result.configureWebServer(config)
 	for _, instanceConfig := range config.Instances {
-		result.Instances[instanceConfig.InstanceName] = NewInstance(config, instanceConfig, result.NotifyOnServiceExit)
+		result.Instances[instanceConfig.InstanceName] = NewInstance(config, instanceConfig, result.NotifyOnServiceExit, result.publishStatus)
+	}
+	return result
+}
+
+func (service *SupervisorService) configureWebServer(config *ServerConfig) {
+	service.WebServer.SetDefinition(webServerDefinition(config), "")
+	service.WebServer.SetCgroup(config.CgroupRoot, serviceCgroupPath(config.CgroupRoot, "", "webserver"))
+	service.WebServer.SetResourceLimits(serviceResourceLimits(config, nil, "webserver"))
+	service.WebServer.SetEventHistory(config.EventHistory)
+	service.WebServer.SetProcessAdoption(config.ProcessAdoption.Enabled)
+	service.WebServer.SetStatusListener(service.publishStatus)
+}
+
+func (service *SupervisorService) getInstance(instanceName string) (*Instance, bool) {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	instance, found := service.Instances[instanceName]
+	return instance, found
+}
+
+func (service *SupervisorService) instancesList() []*Instance {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	result := make([]*Instance, 0, len(service.Instances))
+	for _, instance := range service.Instances {
+		result = append(result, instance)
 	}
 	return result
 }
 
 func (service *SupervisorService) GetSupervisorStatus(context.Context, *Empty) (*SupervisorStatusResponse, error) {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
 	result := &SupervisorStatusResponse{
 		SupervisorPid: int32(os.Getpid()),
 		InstanceNames: make([]string, 0, len(service.Config.Instances)),
@@ -69,19 +114,31 @@ func (service *SupervisorService) GetStatus(ctx context.Context, request *Status
 	if request.InstanceName == "web" || request.InstanceName == "webserver" || request.InstanceName == "grpcwebserver" {
 		services := make([]*ServiceStatusResponse, 1)
 		services[0] = service.WebServer.GetStatus()
+		services[0].Usage = service.WebServer.ResourceUsage()
 		return &StatusResponse{
 			InstanceName:    "webserver",
 			ServiceStatuses: services,
 		}, nil
 	}
-	instance, hasInstance := service.Instances[request.InstanceName]
+	instance, hasInstance := service.getInstance(request.InstanceName)
 	if !hasInstance {
 		return nil, status.Errorf(codes.NotFound, "instance not found: %s", request.InstanceName)
 	}
 	serviceStatuses := instance.GetServiceStatuses()
+	for _, serviceStatus := range serviceStatuses {
+		if instanceService := instance.service(serviceStatus.ServiceName); instanceService != nil {
+			serviceStatus.Usage = instanceService.ResourceUsage()
+		}
+	}
+	var maintenanceUntil int64
+	if until := instance.MaintenanceUntil(); !until.IsZero() {
+		maintenanceUntil = until.Unix()
+	}
 	return &StatusResponse{
-		InstanceName:    request.InstanceName,
-		ServiceStatuses: serviceStatuses,
+		InstanceName:     request.InstanceName,
+		ServiceStatuses:  serviceStatuses,
+		MaintenanceUntil: maintenanceUntil,
+		ScheduledActions: instance.ScheduledActions(time.Now()),
 	}, nil
 }
 
@@ -95,18 +152,26 @@ func (service *SupervisorService) Start(ctx context.Context, request *StartReque
 			ServiceStatuses: services,
 		}, nil
 	}
-	instance, instanceFound := service.Instances[request.InstanceName]
+	instance, instanceFound := service.getInstance(request.InstanceName)
 	if !instanceFound {
 		return nil, status.Errorf(codes.NotFound, "instance %s not found", request.InstanceName)
 	}
+	if until := instance.MaintenanceUntil(); !until.IsZero() {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is under maintenance until %s",
+			request.InstanceName, until.Format(time.RFC3339))
+	}
 
 	// instance configuration might be changed so reload config file before start
-	configFileName := instance.Config.FileName
+	configFileName := instance.config().FileName
 	newConfig, err := LoadSupervisorConfig(configFileName)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "configuration failed in file %s: %v", configFileName, err)
 	}
-	instance.Config = newConfig
+	newConfig.InstanceName = instance.Name
+	changes, _ := instance.ApplyConfig(instance.globalConfig(), newConfig)
+	for _, change := range changes {
+		instance.logger().Infof("instance %s: %s", instance.Name, change)
+	}
 
 	instance.Start(request.ServiceNames)
 	return &StatusResponse{
@@ -125,7 +190,7 @@ func (service *SupervisorService) Stop(ctx context.Context, request *StopRequest
 			ServiceStatuses: services,
 		}, nil
 	}
-	instance, instanceFound := service.Instances[request.InstanceName]
+	instance, instanceFound := service.getInstance(request.InstanceName)
 	if !instanceFound {
 		return nil, status.Errorf(codes.NotFound, "instance %s not found", request.InstanceName)
 	}
@@ -136,19 +201,49 @@ func (service *SupervisorService) Stop(ctx context.Context, request *StopRequest
 	}, nil
 }
 
+// findServices resolves service names of instance, all enabled
+// instance services are returned if no names specified
+func (service *SupervisorService) findServices(instanceName string, serviceNames []string) ([]*Service, error) {
+	if instanceName == "web" || instanceName == "webserver" || instanceName == "grpcwebserver" {
+		return []*Service{service.WebServer}, nil
+	}
+	instance, instanceFound := service.getInstance(instanceName)
+	if !instanceFound {
+		return nil, status.Errorf(codes.NotFound, "instance %s not found", instanceName)
+	}
+	services := instance.services()
+	result := make([]*Service, 0, len(services))
+	if len(serviceNames) == 0 {
+		for _, serviceStatus := range instance.GetServiceStatuses() {
+			if instanceService, exists := services[serviceStatus.ServiceName]; exists && serviceStatus.Status != ServiceStatus_DISABLED {
+				result = append(result, instanceService)
+			}
+		}
+		return result, nil
+	}
+	for _, serviceName := range serviceNames {
+		instanceService, serviceFound := services[serviceName]
+		if !serviceFound {
+			return nil, status.Errorf(codes.NotFound, "service %s not found in instance %s", serviceName, instanceName)
+		}
+		result = append(result, instanceService)
+	}
+	return result, nil
+}
+
 func (service *SupervisorService) NotifyOnServiceExit(instanceName, serviceName string) {
-	if serviceName == "grader" {
-		// grader do not expose any socket, so it is not required to reconnect
+	instance, instanceFound := service.getInstance(instanceName)
+	if !instanceFound {
+		// webserver do not expose any endpoint, so it is not required to reconnect
 		return
 	}
-	if service.WebServer != nil {
-		log.Infof("sending SIGHUP to webserver due to one of services ")
-		service.WebServer.SendSIGHUP()
+	exited := instance.service(serviceName)
+	if exited == nil {
+		return
 	}
-	for _, instance := range service.Instances {
-		if instance != nil && instance.Config.InstanceName == instanceName {
-			instance.NotifyOnServiceExit(serviceName)
-		}
+	message, notifyWebServer := instance.NotifyReconnect(exited)
+	if notifyWebServer && service.WebServer != nil {
+		go service.WebServer.notifyReconnect(message, true)
 	}
 }
 
@@ -166,7 +261,24 @@ func (service *SupervisorService) Main() {
 	go handleSignals()
 	signal.Notify(signalsChan, syscall.SIGINT)
 	signal.Notify(signalsChan, syscall.SIGTERM)
-	service.GRPCServer = grpc.NewServer()
+	signal.Notify(signalsChan, keepServicesSignal)
+	reloadSignalsChan := make(chan os.Signal, 1)
+	handleReloadSignals := func() {
+		for {
+			<-reloadSignalsChan
+			log.Infof("got SIGHUP, reloading configuration")
+			if _, err := service.reloadConfig(); err != nil {
+				log.Errorf("cant reload configuration: %v", err)
+			}
+		}
+	}
+	go handleReloadSignals()
+	signal.Notify(reloadSignalsChan, syscall.SIGHUP)
+	service.GRPCServer = grpc.NewServer(
+		grpc.Creds(peerCredentialsTransport{}),
+		grpc.ChainUnaryInterceptor(logUnary, service.rpcCounters.unaryInterceptor, service.auditUnary, service.authorizeUnary),
+		grpc.ChainStreamInterceptor(logStream, service.rpcCounters.streamInterceptor, service.auditStream, service.authorizeStream),
+	)
 	RegisterSupervisorServer(service.GRPCServer, service)
 	lis, err := net.Listen("unix", service.Config.GRPCSocketFileName)
 	if err != nil {
@@ -174,23 +286,60 @@ func (service *SupervisorService) Main() {
 	}
 	os.Chmod(service.Config.GRPCSocketFileName, 0o660)
 	go service.GRPCServer.Serve(lis)
-	time.AfterFunc(100*time.Millisecond, service.ProcessAutostart)
-	<-exitChan
-	log.Infof("shutting down supervisor and running services")
-	service.WebServer.Stop()
-	for _, instance := range service.Instances {
-		instance.Stop([]string{})
+	// systemd considers supervisor started when it accepts control requests,
+	// autostart progress is reported in status
+	go service.notifySystemd()
+	service.startMetricsServer()
+	service.startRemoteServer()
+	if service.config().ProcessAdoption.Enabled {
+		service.adoptProcesses()
+	}
+	service.startScheduler()
+	go service.collectResourceUsage()
+	time.AfterFunc(100*time.Millisecond, func() {
+		service.ProcessAutostart()
+		service.autostartDone.Store(true)
+		sdNotify("STATUS=" + service.statusSummary())
+	})
+	signum := <-exitChan
+	sdNotify("STOPPING=1")
+	// unit stop or restart keeps services to be adopted, SIGINT stops everything
+	keepServices := signum != syscall.SIGINT && service.config().ProcessAdoption.Enabled
+	if keepServices {
+		log.Infof("shutting down supervisor, running services are kept")
+		service.saveState()
+	} else {
+		log.Infof("shutting down supervisor and running services")
+		service.WebServer.Stop()
+		for _, instance := range service.instancesList() {
+			instance.Stop([]string{})
+		}
 	}
 	service.removeSocketFile()
 	service.removePIDFile()
 	log.Infof("shutdown")
+	if keepServices && signum == keepServicesSignal {
+		// makes systemd start supervisor again, see RestartForceExitStatus
+		os.Exit(keepServicesExitCode)
+	}
 }
 
 func (service *SupervisorService) ProcessAutostart() {
-	for _, instance := range service.Instances {
-		instance.Start([]string{})
+	// instances do not depend on each other, but webserver requires all of them
+	var instancesStarted sync.WaitGroup
+	for _, instance := range service.instancesList() {
+		if !instance.MaintenanceUntil().IsZero() {
+			instance.logger().Infof("instance %s is not started during maintenance", instance.Name)
+			continue
+		}
+		instancesStarted.Add(1)
+		go func(instance *Instance) {
+			instance.Start([]string{})
+			instancesStarted.Done()
+		}(instance)
 	}
-	if service.Config.AutostartGrpcWebServer {
+	instancesStarted.Wait()
+	if service.config().AutostartGrpcWebServer {
 		service.WebServer.Start()
 	}
 }